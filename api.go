@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simonjm/hawkeye/metrics"
+)
+
+// Serves the JSON status and control API until the context is cancelled.
+//
+//	GET  /jobs              list all jobs, ?state= filters by state
+//	POST /jobs              queue {"path": "..."}
+//	GET  /jobs/<id>         show a single job
+//	POST /jobs/<id>/cancel  cancel a queued or running job
+//	POST /jobs/<id>/retry   queue a failed, skipped or cancelled job again
+//	GET  /workers           show the state of the worker pool
+//	POST /workers/pause     stop starting new jobs
+//	POST /workers/resume    start new jobs again
+//	GET  /metrics           Prometheus metrics
+func serveAPI(ctx context.Context, addr string, videosChan chan<- string) {
+	api := &apiHandler{videosChan: videosChan}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", api.jobs)
+	mux.HandleFunc("/jobs/", api.job)
+	mux.HandleFunc("/workers", api.workers)
+	mux.HandleFunc("/workers/", api.workers)
+	mux.Handle("/metrics", metrics.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Printf("Serving the API on %s\n", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+}
+
+type apiHandler struct {
+	videosChan chan<- string
+}
+
+// Handles /jobs
+func (a *apiHandler) jobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		state := jobState(r.URL.Query().Get("state"))
+		jobs := make([]job, 0)
+		for _, j := range store.list() {
+			if state == "" || j.State == state {
+				jobs = append(jobs, j)
+			}
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			writeError(w, http.StatusBadRequest, errors.New(`expected {"path": "..."}`))
+			return
+		}
+
+		video, err := canonicalPath(req.Path)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if info, err := os.Stat(video); err != nil || info.IsDir() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not a file", video))
+			return
+		}
+		if currentConfig().rootFor(video) == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not in a watched directory", video))
+			return
+		}
+
+		if !store.enqueue(video) {
+			writeError(w, http.StatusConflict, fmt.Errorf("%s is already queued or converted", video))
+			return
+		}
+		logger.Printf("Queuing %s\n", video)
+		filesQueued.Inc()
+		a.videosChan <- video
+
+		j, _ := store.lookup(video)
+		writeJSON(w, http.StatusCreated, j)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" is not allowed"))
+	}
+}
+
+// Handles /jobs/<id> and the actions under it
+func (a *apiHandler) job(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	j, ok := store.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %d does not exist", id))
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" is not allowed"))
+			return
+		}
+		writeJSON(w, http.StatusOK, j)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" is not allowed"))
+		return
+	}
+
+	switch parts[1] {
+	case "cancel":
+		switch j.State {
+		case jobQueued, jobRetrying:
+			store.setState(j.Path, jobCancelled, nil)
+			logger.Printf("Cancelled %s\n", j.Path)
+		case jobProbing, jobRunning:
+			// the worker marks the job as cancelled once ffmpeg has stopped
+			if !pool.cancel(j.Path) {
+				writeError(w, http.StatusConflict, fmt.Errorf("job %d is %s but isn't running", id, j.State))
+				return
+			}
+		default:
+			writeError(w, http.StatusConflict, fmt.Errorf("job %d is already %s", id, j.State))
+			return
+		}
+	case "retry":
+		if j.State == jobDone || !j.State.finished() {
+			writeError(w, http.StatusConflict, fmt.Errorf("job %d is %s", id, j.State))
+			return
+		}
+		// videos that gave up for good were moved out of the way
+		if j.Moved != "" {
+			if err := restoreFailed(j); err != nil {
+				writeError(w, http.StatusConflict, fmt.Errorf("job %d can't be retried: %v", id, err))
+				return
+			}
+		}
+		if !store.requeue(j.Path) {
+			writeError(w, http.StatusConflict, fmt.Errorf("job %d is %s", id, j.State))
+			return
+		}
+		logger.Printf("Retrying %s\n", j.Path)
+		a.videosChan <- j.Path
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	j, _ = store.get(id)
+	writeJSON(w, http.StatusOK, j)
+}
+
+// Handles /workers, /workers/pause and /workers/resume
+func (a *apiHandler) workers(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/workers"), "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "pause" && r.Method == http.MethodPost:
+		pool.pause()
+		logger.Println("Paused the workers")
+	case action == "resume" && r.Method == http.MethodPost:
+		pool.resume()
+		logger.Println("Resumed the workers")
+	case action == "" || action == "pause" || action == "resume":
+		writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" is not allowed"))
+		return
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused":  pool.isPaused(),
+		"busy":    pool.busy(),
+		"workers": pool.limit(),
+		"queued":  store.count(jobQueued),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Println(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
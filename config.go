@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the contents of the config file passed with --config. Flags that are passed
+// on the command line win over the settings in the file
+type Config struct {
+	MaxJobs    int                 `yaml:"max_jobs"`   // how many videos are converted at once
+	LogFile    string              `yaml:"log_file"`   // where to log to instead of stdout
+	FFmpeg     string              `yaml:"ffmpeg"`     // path of the ffmpeg binary
+	FFprobe    string              `yaml:"ffprobe"`    // path of the ffprobe binary
+	Process    Process             `yaml:"process"`    // how ffmpeg and ffprobe are run
+	JobLogs    string              `yaml:"job_logs"`   // directory that the stderr of ffmpeg and ffprobe is written to for each job
+	Retry      RetryPolicy         `yaml:"retry"`      // how failed videos are retried
+	Extensions []string            `yaml:"extensions"` // file types that are converted by roots that don't list their own
+	Profiles   map[string]*Profile `yaml:"profiles"`
+	Roots      []*Root             `yaml:"roots"`
+
+	removed []*Root         // roots that were dropped by a reload, kept for the jobs that were already queued
+	tested  map[string]bool // encoders that were tried and whether they work
+}
+
+// Root is a watched directory and how the videos found in it are converted. Unset fields
+// fall back to the command line flags
+type Root struct {
+	Path        string     `yaml:"path"`         // directory that is watched along with its subdirectories
+	OutDir      string     `yaml:"out_dir"`      // where the converted videos go
+	Extensions  []string   `yaml:"extensions"`   // file types that are converted, .mkv and .m4v by default
+	Include     []string   `yaml:"include"`      // globs that a file has to match to be converted, if any
+	Exclude     []string   `yaml:"exclude"`      // globs of files that are never converted
+	Profile     string     `yaml:"profile"`      // name of the transcoding profile
+	PostActions [][]string `yaml:"post_actions"` // commands run after a video was converted
+	Backend     string     `yaml:"backend"`      // how the directory is watched
+	FailedDir   string     `yaml:"failed_dir"`   // where videos that can't be converted are moved to, relative to the root
+	Source      string     `yaml:"source"`       // what happens to videos once they are converted: delete, archive, link, keep or trash
+	ArchiveDir  string     `yaml:"archive_dir"`  // where videos are archived or linked to, relative to the root
+	TrashDir    string     `yaml:"trash_dir"`    // where videos are trashed to, relative to the root
+
+	TrashRetention time.Duration `yaml:"trash_retention"` // how long trashed videos are kept
+
+	profile  *Profile
+	encoders map[string]bool // encoders of the profile that can be used
+}
+
+// Profile decides what happens to each type of stream when a video is converted
+type Profile struct {
+	Video    StreamRule `yaml:"video"`
+	Audio    StreamRule `yaml:"audio"`
+	Subtitle StreamRule `yaml:"subtitle"`
+}
+
+// StreamRule decides which streams of one type are kept, when they are copied and what they
+// are transcoded to otherwise. Each stream is copied or transcoded on its own.
+// Videos can't be converted if a stream can't be copied and there is no codec to transcode it to.
+// A rule without any codecs leaves the choice up to ffmpeg. With a chain of encoders,
+// hardware encoders are used if they work and the last one is usually a software fallback
+type StreamRule struct {
+	Copy     []string `yaml:"copy"`     // codecs that are copied as is
+	Codec    string   `yaml:"codec"`    // encoder used when the stream can't be copied
+	Encoders []string `yaml:"encoders"` // encoders to try in order instead of a single codec, the first one that works is used
+	Bitrate  string   `yaml:"bitrate"`  // target bitrate, e.g. 192k
+	CRF      int      `yaml:"crf"`      // constant rate factor, only used if set. Passed as the quality setting of hardware encoders that have one
+	Preset   string   `yaml:"preset"`   // encoder preset, e.g. veryfast
+	Args     []string `yaml:"args"`     // extra encoder arguments
+
+	// Audio and subtitle streams only
+	Languages      []string `yaml:"languages"`       // languages that are kept, in the order they go in the output. All if empty
+	Default        string   `yaml:"default"`         // language of the stream that is made the default
+	DropCommentary bool     `yaml:"drop_commentary"` // whether commentary tracks are dropped
+}
+
+// The name of the profile that is used when none is picked
+const defaultProfileName = "default"
+
+// Copies h264 video since its too slow to convert videos to that on a raspberry pi and
+// converts the audio to aac if it isn't already
+var defaultProfile = Profile{
+	Video: StreamRule{Copy: []string{"h264"}},
+	Audio: StreamRule{Copy: []string{"aac"}, Codec: "aac", Bitrate: "192k"},
+}
+
+// The name of the built in profile that transcodes video to h264
+const transcodeProfileName = "transcode"
+
+// Copies h264 video and transcodes anything else to h264, with a hardware encoder if
+// there is one that works. Too slow for a raspberry pi without one
+var transcodeProfile = Profile{
+	Video: StreamRule{
+		Copy:     []string{"h264"},
+		Encoders: []string{"h264_v4l2m2m", "h264_vaapi", "h264_qsv", "libx264"},
+		CRF:      23,
+		Preset:   "veryfast",
+	},
+	Audio: defaultProfile.Audio,
+}
+
+// Reads the config file. An empty path returns a config with only the default profile
+func loadConfig(path string) (*Config, error) {
+	config := &Config{Retry: defaultRetryPolicy}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]*Profile)
+	}
+	if _, ok := config.Profiles[defaultProfileName]; !ok {
+		profile := defaultProfile
+		config.Profiles[defaultProfileName] = &profile
+	}
+	if _, ok := config.Profiles[transcodeProfileName]; !ok {
+		profile := transcodeProfile
+		config.Profiles[transcodeProfileName] = &profile
+	}
+
+	for name, profile := range config.Profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("profile %s is empty", name)
+		}
+		for _, rule := range []StreamRule{profile.Video, profile.Audio, profile.Subtitle} {
+			if rule.Codec != "" && len(rule.Encoders) > 0 {
+				return nil, fmt.Errorf("profile %s sets both codec and encoders", name)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// Looks up a profile by name
+func (c *Config) profile(name string) (*Profile, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %s", name)
+	}
+	return profile, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/simonjm/hawkeye/probe"
+)
+
+// Convert video files that come in through the channel until stop is cancelled. Running
+// ffmpeg processes are interrupted when kill is cancelled. Runs in separate goroutine
+func convertFiles(stop, kill context.Context, videosChan <-chan string) {
+	for {
+		// the pool was made smaller when the config was reloaded
+		if pool.retire() {
+			return
+		}
+
+		select {
+		case <-stop.Done():
+			return
+		case video := <-videosChan:
+			// the job is still queued in the store and will be resumed on the next start
+			ctx, cancel := context.WithCancelCause(kill)
+			// jobs can be cancelled while they are waiting in the queue and a video may
+			// be sent more than once, only the first worker to claim it converts it
+			done, ok := pool.start(stop, video, cancel, func() bool { return store.claim(video) })
+			if !ok {
+				cancel(nil)
+				return
+			}
+			if done == nil {
+				cancel(nil)
+				continue
+			}
+
+			convertFile(ctx, video)
+			done()
+		}
+	}
+}
+
+// Converts a single video file with the settings of the root it is in
+func convertFile(ctx context.Context, video string) {
+	// the config may be reloaded while the job is running
+	config := currentConfig()
+
+	// extra check to make sure we only get .mkv files to convert
+	root := config.jobRoot(video)
+	if root == nil {
+		store.setState(video, jobSkipped, errors.New("not in a watched directory"))
+		return
+	}
+	if !root.allows(video) {
+		store.setState(video, jobSkipped, errors.New("file type not allowed"))
+		return
+	}
+
+	output := root.outputPath(video)
+
+	j, _ := store.lookup(video)
+	jlog, err := openJobLog(config.JobLogs, j)
+	if err != nil {
+		failJob(config, root, video, stageOutput, err, nil)
+		return
+	}
+	defer jlog.close()
+
+	prober := config.prober()
+	prober.Stderr = jlog.stderr(append([]string{prober.Path}, probe.Args(video)...)...)
+	info, err := prober.Probe(ctx, video)
+	if err != nil {
+		if interrupted(ctx, video, "") {
+			return
+		}
+		failJob(config, root, video, stageProbe, err, jlog)
+		return
+	}
+
+	// ffmpeg writes to a temporary file that is renamed once it has been verified
+	tmpOutput, err := createTempOutput(root.OutDir, output)
+	if err != nil {
+		failJob(config, root, video, stageOutput, err, jlog)
+		return
+	}
+
+	// encoders that fail on this video are dropped from the ones the root can use
+	usable := make(map[string]bool)
+	for e, ok := range root.encoders {
+		usable[e] = ok
+	}
+	plan, ok := planConversion(video, tmpOutput, info, root, usable)
+	if !ok {
+		logger.Printf("Codec not supported %s\n", video)
+		filesUnsupported.Inc()
+		removeTempOutput(tmpOutput)
+		failJob(config, root, video, stageCodec, errUnsupportedCodec, jlog)
+		return
+	}
+
+	// find out if the output is taken before spending time on converting the video. A file
+	// that is already there is only replaced if an earlier job for the same video wrote it
+	replace, err := store.claimOutput(video, output)
+	if err == nil && !replace {
+		if _, statErr := os.Lstat(output); statErr == nil {
+			err = fmt.Errorf("%s: %w", output, errOutputExists)
+		}
+	}
+	if err != nil {
+		removeTempOutput(tmpOutput)
+		failJob(config, root, video, stageOutput, err, jlog)
+		return
+	}
+
+	store.setEncoder(video, plan.encoder)
+	store.setState(video, jobRunning, nil)
+	started := time.Now()
+	lastLogged := started
+	onProgress := func(p progress) {
+		store.setProgress(video, p)
+		if *progressInterval > 0 && time.Since(lastLogged) >= *progressInterval {
+			lastLogged = time.Now()
+			logger.Printf("Converting %s: %v\n", video, p)
+		}
+	}
+	for {
+		logger.Printf("Running ffmpeg with arguments %v\n", plan.args)
+		err := runFFmpeg(ctx, config, plan.args, info.Format.Duration, onProgress, jlog)
+		if err == nil {
+			break
+		}
+		if interrupted(ctx, video, tmpOutput) {
+			return
+		}
+
+		// a hardware encoder that passed the test encode can still fail on the video
+		next, ok := fallbackConversion(video, tmpOutput, info, root, usable, plan.encoder)
+		if !ok {
+			removeTempOutput(tmpOutput)
+			failJob(config, root, video, stageConvert, err, jlog)
+			return
+		}
+		logger.Printf("Converting %s with %s failed, trying %s: %v\n", video, plan.encoder, next.encoder, err)
+		plan = next
+		store.setEncoder(video, plan.encoder)
+	}
+
+	// make sure the output is complete before getting rid of the source
+	if err := verifyOutput(ctx, config, info, plan.streams, tmpOutput, jlog); err != nil {
+		if interrupted(ctx, video, tmpOutput) {
+			return
+		}
+		removeTempOutput(tmpOutput)
+		failJob(config, root, video, stageVerify, err, jlog)
+		return
+	}
+
+	if err := commitOutput(tmpOutput, output, replace); err != nil {
+		removeTempOutput(tmpOutput)
+		failJob(config, root, video, stageOutput, err, jlog)
+		return
+	}
+
+	conversionSeconds.Observe(time.Since(started).Seconds())
+	if stat, err := os.Stat(video); err == nil {
+		conversionBytes.Observe(float64(stat.Size()))
+	}
+
+	// delete, move or keep the old video. The output is there either way, so the job is
+	// done but keeps the error
+	disposeErr := disposeSource(root, video, output)
+	if disposeErr != nil {
+		logger.Printf("Converted %s but couldn't get rid of the source: %v\n", video, disposeErr)
+	}
+
+	store.setState(video, jobDone, disposeErr)
+	filesConverted.Inc()
+	logger.Printf("Finished %s\n", output)
+
+	root.runPostActions(ctx, video, output)
+}
+
+// Checks if ffmpeg or ffprobe failed because the job was cancelled or we are shutting
+// down. If so the temporary output, if there is one yet, is removed and the job is marked
+// as cancelled or queued again to be resumed on the next start
+func interrupted(ctx context.Context, video, tmpOutput string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	if tmpOutput != "" {
+		removeTempOutput(tmpOutput)
+	}
+
+	if errors.Is(context.Cause(ctx), errJobCancelled) {
+		logger.Printf("Cancelled %s\n", video)
+		store.setState(video, jobCancelled, nil)
+	} else {
+		logger.Printf("Stopped converting %s, it will be resumed on the next start\n", video)
+		store.setState(video, jobQueued, nil)
+	}
+	return true
+}
+
+// Logs the error and either puts the job aside to be retried or marks it as failed at
+// the stage and moves the video to the failed directory of the root. The output of ffmpeg
+// and ffprobe is kept with the job, if anything was run
+func failJob(config *Config, root *Root, video, stage string, err error, jlog *jobLog) {
+	var stderr, logPath string
+	if jlog != nil {
+		stderr, logPath = jlog.tail.String(), jlog.path
+	}
+	if line := lastLine(stderr); line != "" {
+		logger.Printf("%v: %s\n", err, line)
+	} else {
+		logger.Println(err)
+	}
+	store.setLog(video, stderr, logPath)
+
+	attempts := store.countAttempt(video)
+	class := classifyFailure(err, stderr)
+	_, statErr := os.Stat(video)
+	switch {
+	case os.IsNotExist(statErr):
+		// the video is gone, there is nothing to retry or move
+	case class == failTransient && attempts < config.Retry.Attempts:
+		delay := config.Retry.delay(attempts)
+		logger.Printf("Attempt %d of %d at converting %s failed, retrying in %v\n",
+			attempts, config.Retry.Attempts, video, delay.Round(time.Second))
+		jobRetries.Inc()
+		store.retryLater(video, err, time.Now().Add(delay))
+		return
+	default:
+		j, _ := store.lookup(video)
+		moved, moveErr := quarantine(root, j, failureRecord{
+			Source:   video,
+			Stage:    stage,
+			Class:    class,
+			Error:    err.Error(),
+			Attempts: attempts,
+			Stderr:   stderr,
+			Log:      logPath,
+			Failed:   time.Now(),
+		})
+		if moveErr != nil {
+			logger.Printf("Couldn't move %s to the failed directory: %v\n", video, moveErr)
+			break
+		}
+		logger.Printf("Gave up on %s after %d attempts, moved it to %s\n", video, attempts, moved)
+		filesMoved.Inc()
+		store.setMoved(video, moved)
+	}
+
+	filesFailed.Inc(stage)
+	store.setState(video, jobFailed, err)
+}
+
+// What ffmpeg is asked to do with a video
+type conversion struct {
+	args    []string
+	encoder string         // what the video stream is converted with
+	streams map[string]int // how many streams of each type end up in the output
+}
+
+// Builds the ffmpeg arguments to convert a video with the profile of the root. Streams are
+// mapped explicitly: the first video stream, the audio streams the profile keeps and the
+// subtitles if the profile mentions them. Returns false if the profile doesn't support the
+// codecs of the video or none of the usable encoders can convert it
+func planConversion(video, output string, info *probe.MediaInfo, root *Root, usable map[string]bool) (*conversion, bool) {
+	profile := root.profile
+
+	// cover art is a video stream as well
+	var videoStreams []probe.Stream
+	for _, s := range info.StreamsOfType(probe.Video) {
+		if s.Disposition["attached_pic"] != 1 {
+			videoStreams = append(videoStreams, s)
+			break
+		}
+	}
+
+	type streamGroup struct {
+		specifier string
+		codecType string
+		rule      StreamRule
+		streams   []probe.Stream
+	}
+	types := []streamGroup{
+		{"v", probe.Video, profile.Video, videoStreams},
+		{"a", probe.Audio, profile.Audio, profile.Audio.selectStreams(info.StreamsOfType(probe.Audio))},
+	}
+	if profile.Subtitle.isSet() {
+		subtitles := profile.Subtitle.selectStreams(info.StreamsOfType(probe.Subtitle))
+		types = append(types, streamGroup{"s", probe.Subtitle, profile.Subtitle, subtitles})
+	}
+
+	c := &conversion{streams: make(map[string]int)}
+	var global, maps, streamArgs []string
+	for _, t := range types {
+		// there is always a default audio stream, subtitles only get one if the rule asks for it
+		defaultStream := -1
+		if t.specifier != "v" {
+			defaultStream = t.rule.defaultStream(t.streams, t.specifier == "a")
+		}
+
+		for i, s := range t.streams {
+			encoder, ok := t.rule.encoder([]string{s.CodecName}, usable)
+			if !ok {
+				return nil, false
+			}
+
+			specifier := fmt.Sprintf("%s:%d", t.specifier, i)
+			maps = append(maps, "-map", fmt.Sprintf("0:%d", s.Index))
+			streamArgs = append(streamArgs, t.rule.args(specifier, encoder)...)
+
+			switch {
+			case t.specifier == "v":
+				c.encoder = encoder
+				if encoder != "copy" {
+					global = encoderOptionsFor(encoder).global
+				}
+			case i == defaultStream:
+				streamArgs = append(streamArgs, "-disposition:"+specifier, "default")
+			case defaultStream >= 0:
+				streamArgs = append(streamArgs, "-disposition:"+specifier, "0")
+			}
+		}
+		c.streams[t.codecType] = len(t.streams)
+	}
+
+	c.args = append([]string{"-y"}, global...)
+	c.args = append(c.args, "-i", video)
+	c.args = append(c.args, maps...)
+	c.args = append(c.args, streamArgs...)
+	c.args = append(c.args, output)
+	return c, true
+}
+
+// Plans the conversion again without the hardware encoder that failed. Returns false if it
+// isn't a hardware encoder or the chain has nothing else to try
+func fallbackConversion(video, output string, info *probe.MediaInfo, root *Root, usable map[string]bool, failed string) (*conversion, bool) {
+	if !encoderOptionsFor(failed).hardware {
+		return nil, false
+	}
+	usable[failed] = false
+	return planConversion(video, output, info, root, usable)
+}
+
+// Runs ffmpeg until it exits or the context is cancelled and passes its progress to
+// onProgress. duration is the length of the source in seconds. A cancelled ffmpeg gets
+// interrupted first so it can clean up and is killed if it doesn't exit in time. Its
+// stderr goes to the job log
+func runFFmpeg(ctx context.Context, config *Config, args []string, duration float64, onProgress func(progress), jlog *jobLog) error {
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd, done, err := config.ffmpegCommand(ctx, args...)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 3 * time.Second
+	jlog.attach(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// keep reading after a parse error so ffmpeg doesn't block on a full pipe
+	if err := readProgress(stdout, duration, onProgress); err != nil {
+		logger.Println(err)
+		io.Copy(io.Discard, stdout)
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/simonjm/hawkeye/probe"
+)
+
+func TestPlanConversion(t *testing.T) {
+	cover := probe.Stream{Index: 0, CodecName: "mjpeg", CodecType: probe.Video, Disposition: map[string]int{"attached_pic": 1}}
+	video := probe.Stream{Index: 1, CodecName: "hevc", CodecType: probe.Video}
+	eng := testStream(2, probe.Audio, "eng", "")
+	eng.CodecName = "ac3"
+	jpn := testStream(3, probe.Audio, "jpn", "")
+	commentary := testStream(4, probe.Audio, "eng", "Commentary")
+	subtitle := testStream(5, probe.Subtitle, "eng", "")
+	subtitle.CodecName = "subrip"
+	info := &probe.MediaInfo{Streams: []probe.Stream{cover, video, eng, jpn, commentary, subtitle}}
+
+	usable := map[string]bool{"h264_vaapi": true, "libx264": true, "aac": true, "mov_text": true}
+	audio := StreamRule{Copy: []string{"aac"}, Codec: "aac", Bitrate: "192k"}
+
+	tests := []struct {
+		name        string
+		profile     Profile
+		usable      map[string]bool
+		wantOK      bool
+		wantArgs    []string
+		wantEncoder string
+		wantStreams map[string]int
+	}{
+		{
+			name:    "every audio stream",
+			profile: Profile{Video: StreamRule{Copy: []string{"hevc"}}, Audio: audio},
+			usable:  usable,
+			wantOK:  true,
+			wantArgs: []string{"-y", "-i", "in.mkv",
+				"-map", "0:1", "-map", "0:2", "-map", "0:3", "-map", "0:4",
+				"-c:v:0", "copy",
+				"-c:a:0", "aac", "-b:a:0", "192k", "-disposition:a:0", "default",
+				"-c:a:1", "copy", "-disposition:a:1", "0",
+				"-c:a:2", "copy", "-disposition:a:2", "0",
+				"out.mp4"},
+			wantEncoder: "copy",
+			wantStreams: map[string]int{probe.Video: 1, probe.Audio: 3},
+		},
+		{
+			name: "languages, default and commentary",
+			profile: Profile{
+				Video: StreamRule{Copy: []string{"hevc"}},
+				Audio: StreamRule{Copy: []string{"aac", "ac3"}, Languages: []string{"jpn", "eng"}, Default: "eng", DropCommentary: true},
+			},
+			usable: usable,
+			wantOK: true,
+			wantArgs: []string{"-y", "-i", "in.mkv",
+				"-map", "0:1", "-map", "0:3", "-map", "0:2",
+				"-c:v:0", "copy",
+				"-c:a:0", "copy", "-disposition:a:0", "0",
+				"-c:a:1", "copy", "-disposition:a:1", "default",
+				"out.mp4"},
+			wantEncoder: "copy",
+			wantStreams: map[string]int{probe.Video: 1, probe.Audio: 2},
+		},
+		{
+			name: "hardware encoder and subtitles",
+			profile: Profile{
+				Video:    StreamRule{Encoders: []string{"h264_vaapi", "libx264"}, CRF: 23},
+				Audio:    StreamRule{Copy: []string{"aac", "ac3"}, Languages: []string{"eng"}},
+				Subtitle: StreamRule{Codec: "mov_text"},
+			},
+			usable: usable,
+			wantOK: true,
+			wantArgs: []string{"-y", "-vaapi_device", "/dev/dri/renderD128", "-i", "in.mkv",
+				"-map", "0:1", "-map", "0:2", "-map", "0:4", "-map", "0:5",
+				"-c:v:0", "h264_vaapi", "-filter:v:0", "format=nv12,hwupload", "-qp:v:0", "23",
+				"-c:a:0", "copy", "-disposition:a:0", "default",
+				"-c:a:1", "copy", "-disposition:a:1", "0",
+				"-c:s:0", "mov_text",
+				"out.mp4"},
+			wantEncoder: "h264_vaapi",
+			wantStreams: map[string]int{probe.Video: 1, probe.Audio: 2, probe.Subtitle: 1},
+		},
+		{
+			name:    "falls back to the next encoder",
+			profile: Profile{Video: StreamRule{Encoders: []string{"h264_vaapi", "libx264"}}, Audio: StreamRule{Copy: []string{"aac", "ac3"}, Languages: []string{"jpn"}}},
+			usable:  map[string]bool{"h264_vaapi": false, "libx264": true},
+			wantOK:  true,
+			wantArgs: []string{"-y", "-i", "in.mkv",
+				"-map", "0:1", "-map", "0:3",
+				"-c:v:0", "libx264", "-pix_fmt:v:0", "yuv420p",
+				"-c:a:0", "copy", "-disposition:a:0", "default",
+				"out.mp4"},
+			wantEncoder: "libx264",
+			wantStreams: map[string]int{probe.Video: 1, probe.Audio: 1},
+		},
+		{
+			name:    "video can't be converted",
+			profile: Profile{Video: StreamRule{Copy: []string{"h264"}}, Audio: audio},
+			usable:  usable,
+			wantOK:  false,
+		},
+		{
+			name:    "audio can't be converted",
+			profile: Profile{Video: StreamRule{Copy: []string{"hevc"}}, Audio: StreamRule{Copy: []string{"aac"}}},
+			usable:  usable,
+			wantOK:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := tt.profile
+			root := &Root{profile: &profile}
+			got, ok := planConversion("in.mkv", "out.mp4", info, root, tt.usable)
+			if ok != tt.wantOK {
+				t.Fatalf("planConversion() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+
+			if !reflect.DeepEqual(got.args, tt.wantArgs) {
+				t.Errorf("args =\n%v\nwant\n%v", got.args, tt.wantArgs)
+			}
+			if got.encoder != tt.wantEncoder {
+				t.Errorf("encoder = %q, want %q", got.encoder, tt.wantEncoder)
+			}
+			if !reflect.DeepEqual(got.streams, tt.wantStreams) {
+				t.Errorf("streams = %v, want %v", got.streams, tt.wantStreams)
+			}
+		})
+	}
+}
+
+func TestFallbackConversion(t *testing.T) {
+	info := &probe.MediaInfo{Streams: []probe.Stream{{Index: 0, CodecName: "hevc", CodecType: probe.Video}}}
+	profile := Profile{Video: StreamRule{Encoders: []string{"h264_vaapi", "libx264"}}}
+	root := &Root{profile: &profile}
+
+	usable := map[string]bool{"h264_vaapi": true, "libx264": true}
+	next, ok := fallbackConversion("in.mkv", "out.mp4", info, root, usable, "h264_vaapi")
+	if !ok || next.encoder != "libx264" {
+		t.Fatalf("fallbackConversion() after h264_vaapi = %v, %v, want libx264", next, ok)
+	}
+
+	// software encoders aren't given up on
+	if _, ok := fallbackConversion("in.mkv", "out.mp4", info, root, usable, "libx264"); ok {
+		t.Error("fallbackConversion() after libx264 should fail")
+	}
+}
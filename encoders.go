@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// How an encoder is set up. Hardware encoders need the frames uploaded or converted to a
+// pixel format they take and call their quality setting something other than crf
+type encoderOptions struct {
+	hardware bool     // has to be tried before it is used since being listed doesn't mean the device is there
+	global   []string // arguments that go before the input
+	filter   string   // video filter that prepares the frames
+	quality  string   // option that the crf of the rule is passed as, if any
+	bitrate  string   // bitrate used when the rule doesn't set one, for encoders that can't take the crf
+	pixFmt   string   // pixel format of the output, so 10 bit sources end up in a format players can handle
+	preset   bool     // whether the encoder takes -preset
+}
+
+// Encoders that need more than -c and -crf. Anything else is treated like a software encoder
+var encoderTable = map[string]encoderOptions{
+	"h264_v4l2m2m": {hardware: true, filter: "format=yuv420p", bitrate: "4M"},
+	"h264_vaapi": {
+		hardware: true,
+		global:   []string{"-vaapi_device", "/dev/dri/renderD128"},
+		filter:   "format=nv12,hwupload",
+		quality:  "-qp",
+	},
+	"h264_qsv":   {hardware: true, filter: "format=nv12", quality: "-global_quality", preset: true},
+	"libx264":    {quality: "-crf", pixFmt: "yuv420p", preset: true},
+	"libvpx-vp9": {quality: "-crf"},
+}
+
+func encoderOptionsFor(encoder string) encoderOptions {
+	if opts, ok := encoderTable[encoder]; ok {
+		return opts
+	}
+	return encoderOptions{quality: "-crf", preset: true}
+}
+
+// The encoders that are tried in order when streams can't be copied
+func (r StreamRule) chain() []string {
+	if r.Codec != "" {
+		return []string{r.Codec}
+	}
+	return r.Encoders
+}
+
+// Picks the encoder for streams with the codecs. Returns copy if they can be copied and an
+// empty string if the rule leaves it up to ffmpeg. Returns false if the streams can't be
+// copied and none of the encoders can be used
+func (r StreamRule) encoder(codecs []string, usable map[string]bool) (string, bool) {
+	chain := r.chain()
+	if len(codecs) == 0 || (len(r.Copy) == 0 && len(chain) == 0) {
+		return "", true
+	}
+
+	for _, c := range r.Copy {
+		if hasCodec(c, codecs) {
+			return "copy", true
+		}
+	}
+
+	for _, e := range chain {
+		if e == "copy" || usable[e] {
+			return e, true
+		}
+	}
+	return "", false
+}
+
+// Builds the ffmpeg arguments for a stream that is converted with the encoder. The stream
+// specifier is the type and index of the stream in the output, e.g. a:1
+func (r StreamRule) args(specifier, encoder string) []string {
+	if encoder == "" {
+		return nil
+	}
+
+	args := []string{"-c:" + specifier, encoder}
+	if encoder == "copy" {
+		return args
+	}
+
+	opts := encoderOptionsFor(encoder)
+	if strings.HasPrefix(specifier, "v") {
+		if opts.filter != "" {
+			args = append(args, "-filter:"+specifier, opts.filter)
+		}
+		if opts.pixFmt != "" {
+			args = append(args, "-pix_fmt:"+specifier, opts.pixFmt)
+		}
+	}
+	// encoders without a quality setting would be left at the 200k default of ffmpeg
+	bitrate := r.Bitrate
+	if bitrate == "" && opts.quality == "" {
+		bitrate = opts.bitrate
+	}
+	if bitrate != "" {
+		args = append(args, "-b:"+specifier, bitrate)
+	}
+	// options without a stream specifier would apply to every stream of the output
+	if r.CRF > 0 && opts.quality != "" {
+		args = append(args, opts.quality+":"+specifier, strconv.Itoa(r.CRF))
+	}
+	if r.Preset != "" && opts.preset {
+		args = append(args, "-preset:"+specifier, r.Preset)
+	}
+	return append(args, r.Args...)
+}
+
+// Checks which of the encoders in the chains of the profiles that the roots use can be used.
+// Encoders have to be listed by ffmpeg -encoders and hardware encoders have to be able to
+// encode a test frame. Each root gets the result
+func (c *Config) checkEncoders(listed map[string]bool) error {
+	// reloads only run the test encodes again if ffmpeg or how it is run has changed
+	c.tested = make(map[string]bool)
+	if old := currentConfig(); old != nil && old.FFmpeg == c.FFmpeg && reflect.DeepEqual(old.Process, c.Process) {
+		for e, works := range old.tested {
+			c.tested[e] = works
+		}
+	}
+
+	usable := make(map[string]bool)
+	tried := make(map[string]bool)
+	for _, root := range c.Roots {
+		for _, rule := range []StreamRule{root.profile.Video, root.profile.Audio, root.profile.Subtitle} {
+			if rule.Codec != "" && rule.Codec != "copy" && !listed[rule.Codec] {
+				return fmt.Errorf("%s doesn't have the %s encoder that profile %s uses", c.FFmpeg, rule.Codec, root.Profile)
+			}
+
+			found := len(rule.Encoders) == 0
+			for _, e := range rule.chain() {
+				if !tried[e] {
+					tried[e] = true
+					if _, ok := c.tested[e]; !ok && listed[e] {
+						c.tested[e] = c.encoderWorks(e)
+					}
+					usable[e] = listed[e] && c.tested[e]
+				}
+				found = found || usable[e]
+			}
+			if !found {
+				return fmt.Errorf("none of the encoders %v that profile %s uses work with %s", rule.Encoders, root.Profile, c.FFmpeg)
+			}
+		}
+		root.encoders = usable
+	}
+	return nil
+}
+
+// Encodes a test frame with hardware encoders to see if the device they need is there
+func (c *Config) encoderWorks(encoder string) bool {
+	opts := encoderOptionsFor(encoder)
+	if !opts.hardware {
+		return true
+	}
+
+	args := append([]string{"-hide_banner", "-v", "error"}, opts.global...)
+	args = append(args, "-f", "lavfi", "-i", "color=black:s=256x256:d=1", "-frames:v", "1")
+	if opts.filter != "" {
+		args = append(args, "-filter:v", opts.filter)
+	}
+	args = append(args, "-c:v", encoder, "-f", "null", "-")
+
+	if _, err := c.toolOutput(c.FFmpeg, args...); err != nil {
+		logger.Printf("Not using %s: %v\n", encoder, err)
+		return false
+	}
+	logger.Printf("Found a working %s\n", encoder)
+	return true
+}
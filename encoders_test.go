@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStreamRuleEncoder(t *testing.T) {
+	usable := map[string]bool{"h264_vaapi": false, "libx264": true}
+	tests := []struct {
+		name   string
+		rule   StreamRule
+		codecs []string
+		want   string
+		wantOK bool
+	}{
+		{"copied", StreamRule{Copy: []string{"h264"}, Codec: "libx264"}, []string{"h264"}, "copy", true},
+		{"codec", StreamRule{Copy: []string{"h264"}, Codec: "libx264"}, []string{"hevc"}, "libx264", true},
+		{"first usable in the chain", StreamRule{Encoders: []string{"h264_vaapi", "libx264"}}, []string{"hevc"}, "libx264", true},
+		{"nothing usable", StreamRule{Encoders: []string{"h264_vaapi"}}, []string{"hevc"}, "", false},
+		{"can't be copied", StreamRule{Copy: []string{"h264"}}, []string{"hevc"}, "", false},
+		{"up to ffmpeg", StreamRule{}, []string{"hevc"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.rule.encoder(tt.codecs, usable)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("encoder() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestStreamRuleArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      StreamRule
+		specifier string
+		encoder   string
+		want      []string
+	}{
+		{
+			name:      "copy",
+			rule:      StreamRule{CRF: 23, Bitrate: "1M"},
+			specifier: "v:0",
+			encoder:   "copy",
+			want:      []string{"-c:v:0", "copy"},
+		},
+		{
+			name:      "libx264",
+			rule:      StreamRule{CRF: 23, Preset: "veryfast", Args: []string{"-tune", "film"}},
+			specifier: "v:0",
+			encoder:   "libx264",
+			want:      []string{"-c:v:0", "libx264", "-pix_fmt:v:0", "yuv420p", "-crf:v:0", "23", "-preset:v:0", "veryfast", "-tune", "film"},
+		},
+		{
+			name:      "vaapi",
+			rule:      StreamRule{CRF: 23, Preset: "veryfast"},
+			specifier: "v:0",
+			encoder:   "h264_vaapi",
+			want:      []string{"-c:v:0", "h264_vaapi", "-filter:v:0", "format=nv12,hwupload", "-qp:v:0", "23"},
+		},
+		{
+			name:      "v4l2m2m without a bitrate",
+			rule:      StreamRule{CRF: 23},
+			specifier: "v:0",
+			encoder:   "h264_v4l2m2m",
+			want:      []string{"-c:v:0", "h264_v4l2m2m", "-filter:v:0", "format=yuv420p", "-b:v:0", "4M"},
+		},
+		{
+			name:      "v4l2m2m with a bitrate",
+			rule:      StreamRule{Bitrate: "8M"},
+			specifier: "v:0",
+			encoder:   "h264_v4l2m2m",
+			want:      []string{"-c:v:0", "h264_v4l2m2m", "-filter:v:0", "format=yuv420p", "-b:v:0", "8M"},
+		},
+		{
+			name:      "audio",
+			rule:      StreamRule{Bitrate: "192k"},
+			specifier: "a:1",
+			encoder:   "aac",
+			want:      []string{"-c:a:1", "aac", "-b:a:1", "192k"},
+		},
+		{
+			name:      "up to ffmpeg",
+			rule:      StreamRule{Bitrate: "192k"},
+			specifier: "a:0",
+			encoder:   "",
+			want:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.args(tt.specifier, tt.encoder); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
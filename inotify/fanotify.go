@@ -0,0 +1,393 @@
+// +build linux
+
+package inotify
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from fanotify(7). The fanotify event masks share their values with
+// the IN_* flags, so inotify masks are passed straight through.
+const (
+	fanClassNotif     = 0x0
+	fanCloexec        = 0x1
+	fanNonblock       = 0x2
+	fanReportDFIDName = 0xc00 // FAN_REPORT_DIR_FID | FAN_REPORT_NAME
+	fanMarkAdd        = 0x1
+	fanMarkFilesystem = 0x100
+	fanQOverflow      = 0x4000
+	fanOnDir          = 0x40000000
+
+	fanotifyMetadataVersion  = 3
+	fanEventInfoTypeDFIDName = 2
+
+	sizeofFanotifyEventMetadata = 24
+	sizeofFanotifyInfoHeader    = 4
+	sizeofFsid                  = 8
+	sizeofFileHandleHeader      = 8
+)
+
+// struct fanotify_event_metadata
+type fanotifyEventMetadata struct {
+	EventLen    uint32
+	Vers        uint8
+	Reserved    uint8
+	MetadataLen uint16
+	Mask        uint64
+	Fd          int32
+	Pid         int32
+}
+
+// Events that can be requested from a FanotifyWatcher. Anything else in the
+// mask passed to AddRecursive is ignored.
+const fanotifyEvents = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY
+
+// FanotifyWatcher watches whole filesystems with fanotify, so a single mark
+// covers a directory tree no matter how many directories it has. Only events for
+// files below the added directories are delivered. fanotify has no move cookies,
+// so files moved in are reported as Create|MovedTo without the old name.
+//
+// Marking a filesystem needs CAP_SYS_ADMIN and resolving the directory handles
+// in the events needs CAP_DAC_READ_SEARCH.
+type FanotifyWatcher struct {
+	Events   chan Event
+	Errors   chan error
+	mu       sync.Mutex // Map access
+	fd       int
+	poller   *fdPoller
+	roots    map[string]*fanotifyRoot // Map of watched directories (key: path)
+	done     chan struct{}            // Channel for sending a "quit message" to the reader goroutine
+	doneResp chan struct{}            // Channel to respond to Close
+}
+
+// A directory tree that is being watched
+type fanotifyRoot struct {
+	fd   int    // Open directory used to resolve file handles on its filesystem
+	dev  uint64 // Device of the filesystem
+	mask uint32 // inotify flags requested by the caller
+}
+
+// NewFanotifyWatcher establishes a new fanotify watcher and begins waiting for
+// events. It fails with EPERM when the process doesn't have CAP_SYS_ADMIN and
+// with EINVAL on kernels older than 5.9.
+func NewFanotifyWatcher() (*FanotifyWatcher, error) {
+	r, _, errno := unix.Syscall(unix.SYS_FANOTIFY_INIT,
+		fanClassNotif|fanCloexec|fanNonblock|fanReportDFIDName, unix.O_RDONLY|unix.O_LARGEFILE, 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("fanotify_init", errno)
+	}
+	fd := int(r)
+
+	poller, err := newFdPoller(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	w := &FanotifyWatcher{
+		fd:       fd,
+		poller:   poller,
+		roots:    make(map[string]*fanotifyRoot),
+		Events:   make(chan Event),
+		Errors:   make(chan error),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *FanotifyWatcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close removes all marks and closes the events channel.
+func (w *FanotifyWatcher) Close() error {
+	if w.isClosed() {
+		return nil
+	}
+
+	close(w.done)
+	w.poller.wake()
+	<-w.doneResp
+
+	return nil
+}
+
+// AddRecursive starts watching the named directory and every directory below it
+// by marking the filesystem it is on. Only events matching mask are delivered.
+func (w *FanotifyWatcher) AddRecursive(name string, mask uint32) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return errors.New("fanotify instance already closed")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	root := w.roots[name]
+	if root == nil {
+		fd, err := unix.Open(name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		var stat unix.Stat_t
+		if err := unix.Fstat(fd, &stat); err != nil {
+			unix.Close(fd)
+			return &os.PathError{Op: "fstat", Path: name, Err: err}
+		}
+		root = &fanotifyRoot{fd: fd, dev: uint64(stat.Dev)}
+	}
+
+	// directories have to be reported so the files in ones that are moved in can be found
+	flags := uint64(root.mask|mask)&fanotifyEvents | fanOnDir
+	if err := fanotifyMark(w.fd, fanMarkAdd|fanMarkFilesystem, flags, name); err != nil {
+		if w.roots[name] == nil {
+			unix.Close(root.fd)
+		}
+		return &os.PathError{Op: "fanotify_mark", Path: name, Err: err}
+	}
+
+	root.mask |= mask
+	w.roots[name] = root
+	return nil
+}
+
+// Calls fanotify_mark(2), the 64 bit mask is split over two arguments on 32 bit architectures
+func fanotifyMark(fd int, flags uint, mask uint64, path string) error {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	dirFd := unix.AT_FDCWD
+	var errno unix.Errno
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		_, _, errno = unix.Syscall6(unix.SYS_FANOTIFY_MARK, uintptr(fd), uintptr(flags), uintptr(mask),
+			uintptr(dirFd), uintptr(unsafe.Pointer(p)), 0)
+	} else {
+		_, _, errno = unix.Syscall6(unix.SYS_FANOTIFY_MARK, uintptr(fd), uintptr(flags), uintptr(mask), uintptr(mask>>32),
+			uintptr(dirFd), uintptr(unsafe.Pointer(p)))
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readEvents reads from the fanotify file descriptor, converts the received
+// events into Event objects and sends the ones below a watched directory via
+// the Events channel
+func (w *FanotifyWatcher) readEvents() {
+	var buf [4096 * 16]byte
+
+	defer close(w.doneResp)
+	defer close(w.Errors)
+	defer close(w.Events)
+	defer unix.Close(w.fd)
+	defer w.poller.close()
+	defer w.closeRoots()
+
+	for {
+		if w.isClosed() {
+			return
+		}
+
+		ok, errno := w.poller.wait(-1)
+		if errno != nil {
+			if !w.sendError(errno) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		n, errno := unix.Read(w.fd, buf[:])
+		if errno == unix.EINTR || errno == unix.EAGAIN {
+			continue
+		}
+		if w.isClosed() {
+			return
+		}
+		if errno != nil {
+			if !w.sendError(os.NewSyscallError("read", errno)) {
+				return
+			}
+			continue
+		}
+
+		var offset int
+		for offset+sizeofFanotifyEventMetadata <= n {
+			meta := (*fanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			eventLen := int(meta.EventLen)
+			if eventLen < sizeofFanotifyEventMetadata || offset+eventLen > n {
+				break
+			}
+			if !w.handleEvent(meta, buf[offset:offset+eventLen]) {
+				return
+			}
+			offset += eventLen
+		}
+	}
+}
+
+// Converts a single raw event and sends it. Returns false if the watcher was closed
+func (w *FanotifyWatcher) handleEvent(meta *fanotifyEventMetadata, raw []byte) bool {
+	if meta.Vers != fanotifyMetadataVersion {
+		return w.sendError(errors.New("fanotify: unexpected metadata version"))
+	}
+	if meta.Fd >= 0 {
+		unix.Close(int(meta.Fd))
+	}
+	if meta.Mask&fanQOverflow == fanQOverflow {
+		return w.sendError(ErrEventOverflow)
+	}
+
+	name, ok := w.resolve(raw[meta.MetadataLen:])
+	if !ok {
+		return true
+	}
+
+	w.mu.Lock()
+	var root *fanotifyRoot
+	for dir, r := range w.roots {
+		if name == dir || strings.HasPrefix(name, dir+string(filepath.Separator)) {
+			root = r
+			break
+		}
+	}
+	w.mu.Unlock()
+	if root == nil {
+		return true
+	}
+
+	mask := uint32(meta.Mask)
+	isDir := meta.Mask&fanOnDir == fanOnDir
+	if isDir {
+		// a directory that was moved in may already have files in it
+		if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+			return w.sendTree(name)
+		}
+		return true
+	}
+
+	if mask&root.mask == 0 {
+		return true
+	}
+	return w.send(newEvent(name, mask&root.mask))
+}
+
+// Finds the path of the file an event is about from its DFID_NAME info record
+func (w *FanotifyWatcher) resolve(info []byte) (string, bool) {
+	if len(info) < sizeofFanotifyInfoHeader+sizeofFsid+sizeofFileHandleHeader || info[0] != fanEventInfoTypeDFIDName {
+		return "", false
+	}
+
+	handle := info[sizeofFanotifyInfoHeader+sizeofFsid:]
+	handleBytes := int(*(*uint32)(unsafe.Pointer(&handle[0])))
+	handleLen := sizeofFileHandleHeader + handleBytes
+	if handleLen > len(handle) {
+		return "", false
+	}
+	file := handle[handleLen:]
+	if i := bytes.IndexByte(file, 0); i >= 0 {
+		file = file[:i]
+	}
+
+	// file handles are only unique within a filesystem, try the roots until one of them has it
+	fh := make([]byte, handleLen)
+	copy(fh, handle)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, root := range w.roots {
+		dir, ok := openByHandle(root, fh)
+		if !ok {
+			continue
+		}
+		return filepath.Join(dir, string(file)), true
+	}
+	return "", false
+}
+
+// Opens a directory handle relative to the root and returns its path
+func openByHandle(root *fanotifyRoot, handle []byte) (string, bool) {
+	r, _, errno := unix.Syscall(unix.SYS_OPEN_BY_HANDLE_AT, uintptr(root.fd),
+		uintptr(unsafe.Pointer(&handle[0])), unix.O_PATH|unix.O_CLOEXEC)
+	if errno != 0 {
+		return "", false
+	}
+	fd := int(r)
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil || uint64(stat.Dev) != root.dev {
+		return "", false
+	}
+
+	dir, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	if err != nil || strings.HasSuffix(dir, " (deleted)") {
+		return "", false
+	}
+	return dir, true
+}
+
+// Sends a Create event for every file in the directory tree
+func (w *FanotifyWatcher) sendTree(name string) bool {
+	ok := true
+	filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if !w.send(Event{Name: path, Op: Create}) {
+			ok = false
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return ok
+}
+
+// send delivers the event unless the watcher is closed first.
+func (w *FanotifyWatcher) send(event Event) bool {
+	select {
+	case w.Events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *FanotifyWatcher) sendError(err error) bool {
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *FanotifyWatcher) closeRoots() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, root := range w.roots {
+		unix.Close(root.fd)
+		delete(w.roots, name)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 	"bytes"
 
@@ -22,8 +23,9 @@ import (
 
 // Event represents a single file system notification.
 type Event struct {
-	Name string // Relative path to the file or directory.
-	Op   Op     // File operation that triggered the event.
+	Name    string // Relative path to the file or directory.
+	OldName string // Path the file or directory had before a Rename.
+	Op      Op     // File operation that triggered the event.
 }
 
 // Op describes a set of file operations.
@@ -38,6 +40,20 @@ const (
 	Chmod
 )
 
+// These are the inotify specific operations that can trigger a notification.
+// They are set alongside the generalized operations above.
+const (
+	CloseWrite   Op = 1 << (iota + 5) // File opened for writing was closed
+	CloseNoWrite                      // File not opened for writing was closed
+	Open                              // File was opened
+	Access                            // File was read
+	MovedFrom                         // File was moved out of a watched directory
+	MovedTo                           // File was moved into a watched directory
+	DeleteSelf                        // Watched file or directory was deleted
+	MoveSelf                          // Watched file or directory was moved
+	Unmount                           // Filesystem containing the watched file was unmounted
+)
+
 func (op Op) String() string {
 	// Use a buffer for efficient string concatenation
 	var buffer bytes.Buffer
@@ -57,6 +73,33 @@ func (op Op) String() string {
 	if op&Chmod == Chmod {
 		buffer.WriteString("|CHMOD")
 	}
+	if op&CloseWrite == CloseWrite {
+		buffer.WriteString("|CLOSE_WRITE")
+	}
+	if op&CloseNoWrite == CloseNoWrite {
+		buffer.WriteString("|CLOSE_NOWRITE")
+	}
+	if op&Open == Open {
+		buffer.WriteString("|OPEN")
+	}
+	if op&Access == Access {
+		buffer.WriteString("|ACCESS")
+	}
+	if op&MovedFrom == MovedFrom {
+		buffer.WriteString("|MOVED_FROM")
+	}
+	if op&MovedTo == MovedTo {
+		buffer.WriteString("|MOVED_TO")
+	}
+	if op&DeleteSelf == DeleteSelf {
+		buffer.WriteString("|DELETE_SELF")
+	}
+	if op&MoveSelf == MoveSelf {
+		buffer.WriteString("|MOVE_SELF")
+	}
+	if op&Unmount == Unmount {
+		buffer.WriteString("|UNMOUNT")
+	}
 	if buffer.Len() == 0 {
 		return ""
 	}
@@ -64,14 +107,25 @@ func (op Op) String() string {
 }
 
 // String returns a string representation of the event in the form
-// "file: REMOVE|WRITE|..."
+// "file: REMOVE|WRITE|..." or "old -> file: RENAME|..." for renames
 func (e Event) String() string {
+	if e.OldName != "" {
+		return fmt.Sprintf("%q -> %q: %s", e.OldName, e.Name, e.Op.String())
+	}
 	return fmt.Sprintf("%q: %s", e.Name, e.Op.String())
 }
 
 // Common errors that can be reported by a watcher
 var ErrEventOverflow = errors.New("fsnotify queue overflow")
 
+// Flags that are always added to recursive watches so that new subdirectories
+// can be picked up, moved ones followed and removed ones dropped.
+const recursiveFlags = unix.IN_CREATE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// How long the first half of a move is held on to while waiting for the second
+// half. Moves that aren't completed in time left the watched directories.
+const moveTimeout = 100 * time.Millisecond
+
 // Watcher watches a set of files, delivering events to a channel.
 type Watcher struct {
 	Events   chan Event
@@ -79,10 +133,11 @@ type Watcher struct {
 	mu       sync.Mutex // Map access
 	fd       int
 	poller   *fdPoller
-	watches  map[string]*watch // Map of inotify watches (key: path)
-	paths    map[int]string    // Map of watched paths (key: watch descriptor)
-	done     chan struct{}     // Channel for sending a "quit message" to the reader goroutine
-	doneResp chan struct{}     // Channel to respond to Close
+	watches  map[string]*watch       // Map of inotify watches (key: path)
+	paths    map[int]string          // Map of watched paths (key: watch descriptor)
+	moves    map[uint32]*pendingMove // Map of moves waiting for their IN_MOVED_TO (key: cookie), only used by readEvents
+	done     chan struct{}           // Channel for sending a "quit message" to the reader goroutine
+	doneResp chan struct{}           // Channel to respond to Close
 }
 
 // NewWatcher establishes a new watcher with the underlying OS and begins waiting for events.
@@ -103,6 +158,7 @@ func NewWatcher() (*Watcher, error) {
 		poller:   poller,
 		watches:  make(map[string]*watch),
 		paths:    make(map[int]string),
+		moves:    make(map[uint32]*pendingMove),
 		Events:   make(chan Event),
 		Errors:   make(chan error),
 		done:     make(chan struct{}),
@@ -147,10 +203,61 @@ func (w *Watcher) Add(name string, mask uint32) error {
 		return errors.New("inotify instance already closed")
 	}
 
-	var flags uint32 = mask
-
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.add(name, mask, false)
+}
+
+// AddRecursive starts watching the named directory and every directory below it.
+// Directories that are created in or moved into the tree later on are watched
+// automatically and any files already inside of them are reported as Create events.
+// Only events matching mask are delivered on the Events channel.
+func (w *Watcher) AddRecursive(name string, mask uint32) error {
+	name = filepath.Clean(name)
+	if w.isClosed() {
+		return errors.New("inotify instance already closed")
+	}
+
+	_, err := w.addTree(name, mask)
+	return err
+}
+
+// addTree walks the directory tree rooted at name and adds a recursive watch for
+// every directory in it. The paths of the files that were found are returned.
+func (w *Watcher) addTree(name string, mask uint32) ([]string, error) {
+	var files []string
+	err := filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// subdirectories may have been removed or be unreadable, only the root matters
+			if path != name {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			return nil
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err := w.add(path, mask, true); err != nil && path == name {
+			return err
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// add creates or updates the inotify watch for name. The caller must hold w.mu.
+func (w *Watcher) add(name string, mask uint32, recursive bool) error {
+	var flags uint32 = mask
+	if recursive {
+		flags |= recursiveFlags
+	}
+
 	watchEntry := w.watches[name]
 	if watchEntry != nil {
 		flags |= watchEntry.flags | unix.IN_MASK_ADD
@@ -160,12 +267,21 @@ func (w *Watcher) Add(name string, mask uint32) error {
 		return errno
 	}
 
+	// A directory that was moved within the tree keeps its watch descriptor,
+	// so forget about the path it used to have.
+	if oldName, ok := w.paths[wd]; ok && oldName != name {
+		delete(w.watches, oldName)
+	}
+
 	if watchEntry == nil {
-		w.watches[name] = &watch{wd: uint32(wd), flags: flags}
+		w.watches[name] = &watch{wd: uint32(wd), flags: flags, mask: mask, recursive: recursive}
 		w.paths[wd] = name
 	} else {
 		watchEntry.wd = uint32(wd)
 		watchEntry.flags = flags
+		watchEntry.mask |= mask
+		watchEntry.recursive = watchEntry.recursive || recursive
+		w.paths[wd] = name
 	}
 
 	return nil
@@ -212,8 +328,23 @@ func (w *Watcher) Remove(name string) error {
 }
 
 type watch struct {
-	wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
-	flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	wd        uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
+	flags     uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
+	mask      uint32 // inotify flags requested by the caller, used to filter events on recursive watches
+	recursive bool   // New subdirectories are watched automatically
+}
+
+// wants reports whether the caller asked for any of the events in mask.
+func (w watch) wants(mask uint32) bool {
+	return !w.recursive || w.mask&mask != 0
+}
+
+// The IN_MOVED_FROM half of a move
+type pendingMove struct {
+	event    Event     // Event for the old name
+	watch    watch     // Watch the event came from
+	isDir    bool      // Whether a directory was moved
+	deadline time.Time // When the move is treated as leaving the watched directories
 }
 
 // readEvents reads from the inotify file descriptor, converts the
@@ -238,7 +369,20 @@ func (w *Watcher) readEvents() {
 			return
 		}
 
-		ok, errno = w.poller.wait()
+		// Moves that never got their second half are reported as removed, wake
+		// up in time for the next one to expire.
+		if !w.expireMoves(time.Now()) {
+			return
+		}
+		timeout := -1
+		for _, m := range w.moves {
+			wait := int(time.Until(m.deadline)/time.Millisecond) + 1
+			if timeout == -1 || wait < timeout {
+				timeout = wait
+			}
+		}
+
+		ok, errno = w.poller.wait(timeout)
 		if errno != nil {
 			select {
 			case w.Errors <- errno:
@@ -309,6 +453,10 @@ func (w *Watcher) readEvents() {
 			// the "paths" map.
 			w.mu.Lock()
 			name, ok := w.paths[int(raw.Wd)]
+			var watchEntry watch
+			if ok && w.watches[name] != nil {
+				watchEntry = *w.watches[name]
+			}
 			// IN_DELETE_SELF occurs when the file/directory being watched is removed.
 			// This is a sign to clean up the maps, otherwise we are no longer in sync
 			// with the inotify kernel state which has already deleted the watch
@@ -327,13 +475,50 @@ func (w *Watcher) readEvents() {
 			}
 
 			event := newEvent(name, mask)
+			isDir := mask&unix.IN_ISDIR == unix.IN_ISDIR
+			from, paired := w.moves[raw.Cookie]
+
+			switch {
+			case mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM && raw.Cookie != 0:
+				// Hold on to the first half of a move until the second half shows up.
+				w.moves[raw.Cookie] = &pendingMove{
+					event:    event,
+					watch:    watchEntry,
+					isDir:    isDir,
+					deadline: time.Now().Add(moveTimeout),
+				}
+			case mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO && paired:
+				// Both halves of the move happened inside of the watched directories.
+				delete(w.moves, raw.Cookie)
+				if isDir {
+					w.renameTree(from.event.Name, name)
+				}
 
-			// Send the events that are not ignored on the events channel
-			if !event.ignoreLinux(mask) {
-				select {
-				case w.Events <- event:
-				case <-w.done:
-					return
+				var moved uint32 = unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+				if from.watch.wants(moved) || watchEntry.wants(moved) {
+					event = Event{Name: name, OldName: from.event.Name, Op: Rename | MovedFrom | MovedTo}
+					if !w.send(event) {
+						return
+					}
+					if isDir && !w.sendRenamedTree(from.event.Name, name) {
+						return
+					}
+				}
+			default:
+				// Send the events that are not ignored on the events channel. Recursive
+				// watches listen for more than the caller asked for, so filter those out.
+				if !event.ignoreLinux(mask) && watchEntry.wants(mask) {
+					if !w.send(event) {
+						return
+					}
+				}
+
+				// Start watching directories that are created in or moved into a recursive watch.
+				// Anything written to them before the watch was added is reported as created.
+				if watchEntry.recursive && isDir && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					if !w.watchNewDir(name, watchEntry.mask) {
+						return
+					}
 				}
 			}
 
@@ -343,6 +528,113 @@ func (w *Watcher) readEvents() {
 	}
 }
 
+// send delivers an event on the Events channel. Returns false if the watcher was
+// closed first.
+func (w *Watcher) send(event Event) bool {
+	select {
+	case w.Events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// expireMoves reports moves whose second half didn't show up in time as removed.
+// Returns false if the watcher was closed while sending events.
+func (w *Watcher) expireMoves(now time.Time) bool {
+	for cookie, m := range w.moves {
+		if now.Before(m.deadline) {
+			continue
+		}
+		delete(w.moves, cookie)
+
+		// The kernel keeps watching directories that were moved somewhere else.
+		if m.isDir && m.watch.recursive {
+			w.removeTree(m.event.Name)
+		}
+
+		if m.watch.wants(unix.IN_MOVED_FROM) {
+			if !w.send(Event{Name: m.event.Name, Op: Remove | MovedFrom}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// renameTree updates the paths of the watches in a directory that was moved.
+func (w *Watcher) renameTree(oldName, newName string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, watchEntry := range w.watches {
+		if path != oldName && !strings.HasPrefix(path, oldName+"/") {
+			continue
+		}
+
+		newPath := newName + strings.TrimPrefix(path, oldName)
+		delete(w.watches, path)
+		w.watches[newPath] = watchEntry
+		w.paths[int(watchEntry.wd)] = newPath
+	}
+}
+
+// sendRenamedTree sends a Rename event for every file in a directory that was moved,
+// since the kernel only reports the directory itself. Returns false if the watcher
+// was closed while sending events.
+func (w *Watcher) sendRenamedTree(oldName, newName string) bool {
+	ok := true
+	filepath.Walk(newName, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		oldPath := oldName + strings.TrimPrefix(path, newName)
+		if !w.send(Event{Name: path, OldName: oldPath, Op: Rename | MovedFrom | MovedTo}) {
+			ok = false
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return ok
+}
+
+// removeTree removes the watches of a directory and everything below it.
+func (w *Watcher) removeTree(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, watchEntry := range w.watches {
+		if path != name && !strings.HasPrefix(path, name+"/") {
+			continue
+		}
+
+		delete(w.paths, int(watchEntry.wd))
+		delete(w.watches, path)
+		// The watch may already be gone if the directory was deleted.
+		unix.InotifyRmWatch(w.fd, watchEntry.wd)
+	}
+}
+
+// watchNewDir adds recursive watches for a directory that appeared inside of a
+// recursive watch. Returns false if the watcher was closed while sending events.
+func (w *Watcher) watchNewDir(name string, mask uint32) bool {
+	files, err := w.addTree(name, mask)
+	if err != nil && !os.IsNotExist(err) {
+		select {
+		case w.Errors <- err:
+		case <-w.done:
+			return false
+		}
+	}
+
+	for _, f := range files {
+		if !w.send(Event{Name: f, Op: Create}) {
+			return false
+		}
+	}
+	return true
+}
+
 // Certain types of events can be "ignored" and not sent over the Events
 // channel. Such as events marked ignore by the kernel, or MODIFY events
 // against files that do not exist.
@@ -382,5 +674,32 @@ func newEvent(name string, mask uint32) Event {
 	if mask&unix.IN_ATTRIB == unix.IN_ATTRIB {
 		e.Op |= Chmod
 	}
+	if mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
+		e.Op |= CloseWrite
+	}
+	if mask&unix.IN_CLOSE_NOWRITE == unix.IN_CLOSE_NOWRITE {
+		e.Op |= CloseNoWrite
+	}
+	if mask&unix.IN_OPEN == unix.IN_OPEN {
+		e.Op |= Open
+	}
+	if mask&unix.IN_ACCESS == unix.IN_ACCESS {
+		e.Op |= Access
+	}
+	if mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
+		e.Op |= MovedFrom
+	}
+	if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+		e.Op |= MovedTo
+	}
+	if mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
+		e.Op |= DeleteSelf
+	}
+	if mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
+		e.Op |= MoveSelf
+	}
+	if mask&unix.IN_UNMOUNT == unix.IN_UNMOUNT {
+		e.Op |= Unmount
+	}
 	return e
 }
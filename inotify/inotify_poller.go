@@ -73,17 +73,17 @@ func newFdPoller(fd int) (*fdPoller, error) {
 	return poller, nil
 }
 
-// Wait using epoll.
+// Wait using epoll for at most timeout milliseconds, or forever if timeout is -1.
 // Returns true if something is ready to be read,
 // false if there is not.
-func (poller *fdPoller) wait() (bool, error) {
+func (poller *fdPoller) wait(timeout int) (bool, error) {
 	// 3 possible events per fd, and 2 fds, makes a maximum of 6 events.
 	// I don't know whether epoll_wait returns the number of events returned,
 	// or the total number of events ready.
 	// I decided to catch both by making the buffer one larger than the maximum.
 	events := make([]unix.EpollEvent, 7)
 	for {
-		n, errno := unix.EpollWait(poller.epfd, events, -1)
+		n, errno := unix.EpollWait(poller.epfd, events, timeout)
 		if n == -1 {
 			if errno == unix.EINTR {
 				continue
@@ -91,7 +91,10 @@ func (poller *fdPoller) wait() (bool, error) {
 			return false, errno
 		}
 		if n == 0 {
-			// If there are no events, try again.
+			// If there are no events, try again unless we timed out.
+			if timeout >= 0 {
+				return false, nil
+			}
 			continue
 		}
 		if n > 6 {
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// How many bytes of the stderr of ffmpeg and ffprobe are kept with a failed job
+const stderrTailSize = 8 * 1024
+
+// Keeps the last size bytes that were written to it
+type tailBuffer struct {
+	size    int
+	buf     []byte
+	dropped bool // Whether anything was dropped from the front
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > t.size {
+		p = p[len(p)-t.size:]
+		t.dropped = true
+	}
+	if over := len(t.buf) + len(p) - t.size; over > 0 {
+		t.buf = t.buf[over:]
+		t.dropped = true
+	}
+	t.buf = append(t.buf, p...)
+	return n, nil
+}
+
+// Returns what was kept, starting at a whole line if the front was dropped
+func (t *tailBuffer) String() string {
+	s := string(t.buf)
+	if t.dropped {
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	return strings.TrimRight(s, "\n")
+}
+
+// Collects the stderr of every command that is run for a job. The end of it is kept in
+// memory and everything is appended to a log file for the job if there is a directory for them
+type jobLog struct {
+	tail tailBuffer
+	file *os.File
+	path string
+}
+
+// Opens the log for the job. Without a directory only the tail is kept
+func openJobLog(dir string, j job) (*jobLog, error) {
+	l := &jobLog{tail: tailBuffer{size: stderrTailSize}}
+	if dir == "" {
+		return l, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s.log", j.ID, filepath.Base(j.Path)))
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.file, l.path = file, path
+	return l, nil
+}
+
+// Returns the writer for the stderr of a command, after noting which command it is
+func (l *jobLog) stderr(args ...string) io.Writer {
+	var w io.Writer = &l.tail
+	if l.file != nil {
+		w = io.MultiWriter(&l.tail, l.file)
+	}
+	fmt.Fprintf(w, "$ %s\n", strings.Join(args, " "))
+	return w
+}
+
+// Sends the stderr of the command to the log
+func (l *jobLog) attach(cmd *exec.Cmd) {
+	cmd.Stderr = l.stderr(cmd.Args...)
+}
+
+// Returns the last line of the output, which is usually the error. Lines that only
+// note which command was run don't count
+func lastLine(s string) string {
+	line := s[strings.LastIndexByte(s, '\n')+1:]
+	if strings.HasPrefix(line, "$ ") {
+		return ""
+	}
+	return line
+}
+
+func (l *jobLog) close() {
+	if l.file == nil {
+		return
+	}
+	if err := l.file.Close(); err != nil {
+		logger.Println(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 16, nil, ""},
+		{"fits", 16, []string{"one\n", "two\n"}, "one\ntwo"},
+		{"drops the front at a line", 10, []string{"first\n", "second\n", "third\n"}, "third"},
+		{"single write that is too big", 8, []string{"aaaa\nbbbbbb\ncc\n"}, "cc"},
+		{"no whole line left", 4, []string{"abcdefgh"}, "efgh"},
+		{"partial last line", 16, []string{"one\ntw", "o"}, "one\ntwo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &tailBuffer{size: tt.size}
+			for _, w := range tt.writes {
+				n, err := b.Write([]byte(w))
+				if n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if len(b.buf) > tt.size {
+				t.Errorf("kept %d bytes, more than %d", len(b.buf), tt.size)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"Error: boom", "Error: boom"},
+		{"$ ffmpeg -i a.mkv\nError: boom", "Error: boom"},
+		{"Error: boom\n$ ffprobe a.mkv", ""},
+	}
+
+	for _, tt := range tests {
+		if got := lastLine(tt.in); got != tt.want {
+			t.Errorf("lastLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
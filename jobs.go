@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The state of a job in the job store
+type jobState string
+
+const (
+	jobQueued    jobState = "queued"
+	jobRetrying  jobState = "retrying"
+	jobProbing   jobState = "probing"
+	jobRunning   jobState = "running"
+	jobDone      jobState = "done"
+	jobFailed    jobState = "failed"
+	jobSkipped   jobState = "skipped"
+	jobCancelled jobState = "cancelled"
+)
+
+// Checks if a job in this state has finished and won't be run again
+func (s jobState) finished() bool {
+	return s == jobDone || s == jobFailed || s == jobSkipped || s == jobCancelled
+}
+
+// A video that has been queued for conversion
+type job struct {
+	ID       int64     `json:"id"`
+	Path     string    `json:"path"`
+	State    jobState  `json:"state"`
+	Output   string    `json:"output,omitempty"`
+	Encoder  string    `json:"encoder,omitempty"` // what the video stream is converted with, copy if it is copied
+	Error    string    `json:"error,omitempty"`
+	Stderr   string    `json:"stderr,omitempty"`   // end of the ffmpeg and ffprobe output of the last failed attempt
+	Log      string    `json:"log,omitempty"`      // file with all of the ffmpeg and ffprobe output
+	Progress *progress `json:"progress,omitempty"` // only set while ffmpeg is running
+	Attempts int       `json:"attempts,omitempty"` // how many times converting the video has failed
+	RetryAt  time.Time `json:"retry_at"`
+	Moved    string    `json:"moved,omitempty"`  // where the video was moved to after it failed for good
+	Device   uint64    `json:"device,omitempty"` // the file that was queued, so changes to it can be told apart
+	Inode    uint64    `json:"inode,omitempty"`  // from events that fire again for the same file
+	Size     int64     `json:"size,omitempty"`
+	ModTime  time.Time `json:"mod_time"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+	Finished time.Time `json:"finished"`
+}
+
+// Keeps track of the state of every job and records each change in an append-only
+// journal, so unfinished jobs can be resumed after a restart
+type jobStore struct {
+	mu     sync.Mutex
+	file   *os.File
+	jobs   map[string]*job // Map of jobs (key: path of the video)
+	nextID int64
+}
+
+// Opens the journal at path, replays it and compacts it down to one line per job.
+// Finished jobs whose video no longer exists are dropped, unless they are done and their
+// output is still there
+func openJobStore(path string) (*jobStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	s := &jobStore{jobs: make(map[string]*job), nextID: 1}
+	if err := s.replay(path); err != nil {
+		return nil, err
+	}
+
+	for p, j := range s.jobs {
+		if !j.State.finished() {
+			continue
+		}
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			continue
+		}
+		// done jobs are kept while their output is there so it stays theirs
+		if j.State == jobDone && j.Output != "" {
+			if _, err := os.Stat(j.Output); err == nil {
+				continue
+			}
+		}
+		delete(s.jobs, p)
+	}
+
+	if err := s.compact(path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// Reads every line of the journal, the last line for a job wins. If there are
+// several jobs for the same video the newest one is kept
+func (s *jobStore) replay(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	byID := make(map[int64]*job)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		j := new(job)
+		if err := json.Unmarshal(scanner.Bytes(), j); err != nil {
+			// the last line may be cut off if we crashed while writing it
+			logger.Printf("Skipping bad line in %s: %v\n", path, err)
+			continue
+		}
+
+		byID[j.ID] = j
+		if j.ID >= s.nextID {
+			s.nextID = j.ID + 1
+		}
+	}
+
+	// jobs keep their ID when their video is renamed
+	for _, j := range byID {
+		if existing, ok := s.jobs[j.Path]; !ok || existing.ID < j.ID {
+			s.jobs[j.Path] = j
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Rewrites the journal with only the current state of each job
+func (s *jobStore) compact(path string) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, j := range s.sorted() {
+		if err := enc.Encode(j); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Returns all the jobs ordered by ID. The caller must hold s.mu or own the store
+func (s *jobStore) sorted() []*job {
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID < jobs[b].ID })
+	return jobs
+}
+
+// Appends the job to the journal. The caller must hold s.mu
+func (s *jobStore) write(j *job) {
+	data, err := json.Marshal(j)
+	if err != nil {
+		logger.Println(err)
+		return
+	}
+
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		logger.Println(err)
+		return
+	}
+	if err := s.file.Sync(); err != nil {
+		logger.Println(err)
+	}
+}
+
+// Records a new job for the video. Returns false if the video is already waiting to be
+// converted or being converted, under this or another name, or if it has finished and
+// the file hasn't changed since
+func (s *jobStore) enqueue(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	dev, ino := fileID(info)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if ok && (!j.State.finished() || !j.changed(info)) {
+		return false
+	}
+
+	// hard links and paths that lead to the same file through a bind mount
+	for _, other := range s.jobs {
+		if !other.State.finished() && other.Inode != 0 && other.Device == dev && other.Inode == ino {
+			return false
+		}
+	}
+
+	// a new version of the video may replace the output of the old one
+	var output string
+	if ok {
+		output = j.Output
+	}
+
+	now := time.Now()
+	j = &job{
+		ID:      s.nextID,
+		Path:    path,
+		State:   jobQueued,
+		Output:  output,
+		Device:  dev,
+		Inode:   ino,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Queued:  now,
+		Updated: now,
+	}
+	s.nextID++
+	s.jobs[path] = j
+	s.write(j)
+	return true
+}
+
+// Checks if the file is not the one that was queued for the job or has been modified
+// since. Jobs from older journals only know when they finished
+func (j *job) changed(info os.FileInfo) bool {
+	if j.Inode == 0 {
+		return info.ModTime().After(j.Finished)
+	}
+
+	dev, ino := fileID(info)
+	return dev != j.Device || ino != j.Inode || info.Size() != j.Size || !info.ModTime().Equal(j.ModTime)
+}
+
+// Returns the device and inode of the file
+func fileID(info os.FileInfo) (uint64, uint64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(stat.Dev), uint64(stat.Ino)
+}
+
+// Moves a queued job to probing so that only one worker gets to convert it, even if
+// the video was sent to the workers more than once. Returns false if it isn't queued
+func (s *jobStore) claim(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok || j.State != jobQueued {
+		return false
+	}
+	s.transition(j, jobProbing, nil)
+	return true
+}
+
+// Moves the job for the video to a new state. The error is recorded for failed jobs
+func (s *jobStore) setState(path string, state jobState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok {
+		return
+	}
+	s.transition(j, state, err)
+}
+
+// Moves the job to the state and writes it to the journal. The caller must hold s.mu
+func (s *jobStore) transition(j *job, state jobState, err error) {
+	j.State = state
+	j.Updated = time.Now()
+	j.Error = ""
+	j.Progress = nil
+	if state == jobProbing {
+		j.Stderr = ""
+	}
+	if err != nil {
+		j.Error = err.Error()
+	}
+	if state == jobProbing && j.Started.IsZero() {
+		j.Started = j.Updated
+	}
+	if state.finished() {
+		j.Finished = j.Updated
+	}
+	s.write(j)
+}
+
+// Returns the state of the job for the video
+func (s *jobStore) state(path string) (jobState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok {
+		return "", false
+	}
+	return j.State, true
+}
+
+// Returns a copy of the job with the ID
+func (s *jobStore) get(id int64) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.ID == id {
+			return *j, true
+		}
+	}
+	return job{}, false
+}
+
+// Returns a copy of the job for the video
+func (s *jobStore) lookup(path string) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// Returns copies of all the jobs ordered by ID
+func (s *jobStore) list() []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.sorted() {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// Queues a finished job again, even if it was done
+func (s *jobStore) requeue(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok || !j.State.finished() {
+		return false
+	}
+
+	now := time.Now()
+	j.State = jobQueued
+	j.Error = ""
+	j.Stderr = ""
+	j.Attempts = 0
+	j.RetryAt = time.Time{}
+	j.Moved = ""
+	j.Queued = now
+	j.Started = time.Time{}
+	j.Updated = now
+	j.Finished = time.Time{}
+	s.write(j)
+	return true
+}
+
+// Moves a job that is queued or waiting to be retried over to the new path of its video
+// and returns its state. Returns false if there is no such job for the old path
+func (s *jobStore) rename(oldPath, newPath string) (jobState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[oldPath]
+	if !ok || (j.State != jobQueued && j.State != jobRetrying) {
+		return "", false
+	}
+
+	delete(s.jobs, oldPath)
+	j.Path = newPath
+	j.Updated = time.Now()
+	s.jobs[newPath] = j
+	s.write(j)
+	return j.State, true
+}
+
+// Records the encoder of the video stream
+func (s *jobStore) setEncoder(path, encoder string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[path]; ok {
+		j.Encoder = encoder
+	}
+}
+
+// Records the output of the job unless another video that is being converted or is done
+// already has it, in which case errOutputExists is returned. Returns true if the output
+// belonged to the video already, from an earlier attempt or an earlier job for the same
+// path, and may be replaced
+func (s *jobStore) claimOutput(path, output string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok {
+		return false, nil
+	}
+	for _, other := range s.jobs {
+		if other != j && other.Output == output && (other.State == jobDone || !other.State.finished()) {
+			return false, fmt.Errorf("%s is the output of %s: %w", output, other.Path, errOutputExists)
+		}
+	}
+
+	own := j.Output == output
+	j.Output = output
+	return own, nil
+}
+
+// Records the output of ffmpeg and ffprobe, it is written along with the next state
+func (s *jobStore) setLog(path, stderr, log string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[path]; ok {
+		j.Stderr = stderr
+		j.Log = log
+	}
+}
+
+// Counts a failed attempt at converting the video and returns how many there have been.
+// It is written along with the next state
+func (s *jobStore) countAttempt(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[path]
+	if !ok {
+		return 0
+	}
+	j.Attempts++
+	return j.Attempts
+}
+
+// Puts the job aside until it is time to retry it
+func (s *jobStore) retryLater(path string, err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[path]; ok {
+		j.RetryAt = at
+		s.transition(j, jobRetrying, err)
+	}
+}
+
+// Queues the jobs whose time to be retried has come and returns their paths
+func (s *jobStore) dueRetries(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var paths []string
+	for _, j := range s.sorted() {
+		if j.State == jobRetrying && !j.RetryAt.After(now) {
+			j.RetryAt = time.Time{}
+			s.transition(j, jobQueued, nil)
+			paths = append(paths, j.Path)
+		}
+	}
+	return paths
+}
+
+// Records where the video was moved to after it failed, it is written along with the next state
+func (s *jobStore) setMoved(path, moved string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[path]; ok {
+		j.Moved = moved
+	}
+}
+
+// Records how far along the conversion of the video is. Progress isn't written to the
+// journal since it changes too often and is meaningless after a restart
+func (s *jobStore) setProgress(path string, p progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[path]; ok && j.State == jobRunning {
+		j.Progress = &p
+	}
+}
+
+// Returns the number of jobs in the state
+func (s *jobStore) count(state jobState) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, j := range s.jobs {
+		if j.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the paths of the jobs that were queued or running, oldest first
+func (s *jobStore) unfinished() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var paths []string
+	for _, j := range s.sorted() {
+		if !j.State.finished() && j.State != jobRetrying {
+			paths = append(paths, j.Path)
+		}
+	}
+	return paths
+}
+
+// Closes the journal
+func (s *jobStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -1,204 +1,343 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
-	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/simonjm/hawkeye/inotify"
+	"github.com/simonjm/hawkeye/probe"
+	"github.com/simonjm/hawkeye/watch"
 	"golang.org/x/sys/unix"
 )
 
 var (
-	maxJobs = flag.Int("max-jobs", 2, "The max amount of .mkv files that can be processing at once")
-	outDir  = flag.String("out-dir", "", "The directory to output mp4 files")
-	logFile = flag.String("log-file", "", "The location of the log file")
+	maxJobs     = flag.Int("max-jobs", 2, "The max amount of .mkv files that can be processing at once")
+	outDir      = flag.String("out-dir", "", "The directory to output mp4 files, unless a root in the config file has its own")
+	logFile     = flag.String("log-file", "", "The location of the log file")
+	settleTime  = flag.Duration("settle-time", 10*time.Second, "How long a file must stay unchanged before it is queued")
+	configFile  = flag.String("config", "", "The location of the config file, it is reloaded on SIGHUP")
+	profileName = flag.String("profile", defaultProfileName, "The name of the transcoding profile to use")
+	stateDir    = flag.String("state-dir", "", "The directory to keep the job journal in (default .hawkeye in the first output directory)")
+
+	verifyTolerance  = flag.Duration("verify-tolerance", 2*time.Second, "How much the duration of the output may differ from the source")
+	verifyDecode     = flag.Bool("verify-decode", false, "Decode the whole output before deleting the source")
+	listenAddr       = flag.String("listen", "", "The address to serve the HTTP API and metrics on, e.g. :8080")
+	gracePeriod      = flag.Duration("grace-period", 5*time.Second, "How long running jobs get to finish on shutdown before they are cancelled")
+	watchBackend     = flag.String("watch-backend", string(watch.Auto), "How to watch the directory: inotify, fanotify, poll or auto to poll network filesystems")
+	pollInterval     = flag.Duration("poll-interval", 10*time.Second, "How often the directory is walked when it is polled")
+	ffmpegPath       = flag.String("ffmpeg", "ffmpeg", "The ffmpeg binary, looked up in $PATH unless it is a path")
+	ffprobePath      = flag.String("ffprobe", probe.Path, "The ffprobe binary, looked up in $PATH unless it is a path")
+	jobLogs          = flag.String("job-logs", "", "The directory to write the ffmpeg and ffprobe output of each job to")
+	progressInterval = flag.Duration("progress-interval", 30*time.Second, "How often the progress of running conversions is logged, 0 to never log it")
 )
 
 var logger *log.Logger
 
-var allowedFileTypes = []string{".mkv", ".m4v"}
+// Keeps track of every job so they survive restarts
+var store *jobStore
+
+// Lets the workers be paused and running jobs be cancelled
+var pool = newWorkerPool()
 
 func main() {
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
 
-	watchDir := flag.Arg(0)
-	if watchDir == "" {
-		log.Fatal("The last argument must be a path to the directory to watch")
-	}
+	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 
-	if *outDir == "" {
-		log.Fatal("--out-dir is required")
+	config, err := readConfig()
+	if err != nil {
+		logger.Fatal(err)
 	}
-
-	if err := os.MkdirAll(*outDir, 0755); err != nil {
-		log.Fatal(err)
+	if err := openLog(config.LogFile); err != nil {
+		logger.Fatal(err)
 	}
+	defer closeLog()
 
-	var logWriter io.Writer
-	if *logFile == "" {
-		logWriter = os.Stdout
-	} else {
-		logFile, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer logFile.Close()
-		logWriter = logFile
+	// partial outputs from earlier runs are never going to be finished
+	if err := prepareOutDirs(config, true); err != nil {
+		logger.Fatal(err)
 	}
-
-	logger = log.New(logWriter, "", log.Ldate|log.Ltime|log.Lshortfile)
-
-	// set up ffmpeg worker goroutines
-	videosChan := make(chan string, 10000)
-	for i := 0; i < *maxJobs; i++ {
-		logger.Printf("Worker %d has started\n", i+1)
-		go convertFiles(videosChan)
+	if err := config.setupCgroup(); err != nil {
+		logger.Fatal(err)
 	}
+	setConfig(config)
 
-	watchDirectory(watchDir, videosChan)
-}
+	if *stateDir == "" {
+		*stateDir = filepath.Join(config.Roots[0].OutDir, ".hawkeye")
+	}
 
-func findInitialFiles(watchDir string, pathChan chan<- string) {
-	logger.Printf("Checking %s for initial %v files \n", watchDir, allowedFileTypes)
+	store, err = openJobStore(filepath.Join(*stateDir, "jobs.journal"))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer store.close()
 
-	for _, ext := range allowedFileTypes {
-		searchPattern := filepath.Join(watchDir, fmt.Sprintf("*%s", ext))
-		files, err := filepath.Glob(searchPattern)
-		if err != nil {
-			logger.Println(err)
-			continue
-		}
+	// workers stop taking new videos once stop is cancelled and running jobs are
+	// cancelled along with kill
+	stop, stopWorkers := context.WithCancel(context.Background())
+	kill, killJobs := context.WithCancel(context.Background())
+	defer killJobs()
 
-		for _, f := range files {
-			logger.Printf("Queuing %s\n", f)
-			pathChan <- f
+	// set up ffmpeg worker goroutines, more are started when the pool grows
+	var wg sync.WaitGroup
+	videosChan := make(chan string, 10000)
+	workers := 0
+	startWorkers := func(n int) {
+		for i := 0; i < n; i++ {
+			workers++
+			logger.Printf("Worker %d has started\n", workers)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				convertFiles(stop, kill, videosChan)
+			}()
 		}
 	}
-}
-
-// Starts watching a directory for new .mkv files and writes the path to the channel
-func watchDirectory(watchDir string, pathChan chan<- string) {
-	go findInitialFiles(watchDir, pathChan)
+	startWorkers(pool.resize(config.MaxJobs))
 
-	watcher, err := inotify.NewWatcher()
-	if err != nil {
-		logger.Fatal(err)
+	// pick up where we left off before the last restart
+	for _, video := range store.unfinished() {
+		logger.Printf("Resuming %s\n", video)
+		store.setState(video, jobQueued, nil)
+		videosChan <- video
 	}
 
-	err = watcher.Add(watchDir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
-	if err != nil {
+	// files wait here until they are done being written
+	eventsChan := make(chan inotify.Event, 10000)
+	go settleFiles(stop, eventsChan, videosChan, *settleTime)
+	go retryJobs(stop, videosChan)
+	go purgeTrash(stop, time.Hour)
+	watchers := newRootWatchers(stop, eventsChan)
+	if err := watchers.update(config.Roots); err != nil {
 		logger.Fatal(err)
 	}
 
-	logger.Printf("Started watching for video files at %s\n", watchDir)
+	if *listenAddr != "" {
+		go serveAPI(stop, *listenAddr, videosChan)
+	}
 
-	for {
-		select {
-		case ev := <-watcher.Events:
-			if !isAllowedFile(ev.Name) {
-				continue
+	// the config is reloaded on SIGHUP until we start shutting down
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, unix.SIGHUP)
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case <-hups:
+				reloadConfig(watchers, startWorkers)
 			}
-			logger.Printf("Queuing %s\n", ev.Name)
-			pathChan <- ev.Name
-		case err := <-watcher.Errors:
-			logger.Println(err)
 		}
+	}()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	logger.Printf("Received %v, shutting down\n", <-sigs)
+	stopWorkers()
+	<-reloaded
+
+	go func() {
+		<-sigs
+		logger.Println("Received a second signal, exiting now")
+		os.Exit(1)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(*gracePeriod):
+		logger.Printf("Jobs are still running after %v, cancelling them\n", *gracePeriod)
+		killJobs()
+		<-done
 	}
-}
 
-// Convert video files that come in through the channel. Runs in separate goroutine
-func convertFiles(videosChan <-chan string) {
-	for video := range videosChan {
-		// extra check to make sure we only get .mkv files to convert
-		if !isAllowedFile(video) {
-			continue
-		}
+	logger.Println("Stopped")
+}
 
-		mp4File := strings.Replace(video, filepath.Ext(video), ".mp4", 1)
-		output := filepath.Join(*outDir, filepath.Base(mp4File))
+func findInitialFiles(ctx context.Context, root *Root, eventsChan chan<- inotify.Event) {
+	logger.Printf("Checking %s for initial %v files \n", root.Path, root.Extensions)
 
-		commandArgs := []string{"-y", "-i", video, "-c:v", "copy", "-c:a"}
-		codecs, err := getCodecs(video)
+	err := filepath.Walk(root.Path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			logger.Println(err)
-			continue
+			return nil
 		}
 
-		// h264 videos are supported and its too slow to convert videos to that on a raspberry pi
-		if !hasCodec("h264", codecs) {
-			logger.Printf("Codec not supported %s\n", video)
-			continue
+		if info.IsDir() || !isAllowedFile(path) {
+			return nil
 		}
 
-		// check if we need to convert the audio and append the correct args
-		if !hasCodec("aac", codecs) {
-			commandArgs = append(commandArgs, "aac", "-b:a", "192k", output)
-		} else {
-			commandArgs = append(commandArgs, "copy", output)
+		logger.Printf("Found %s\n", path)
+		select {
+		case eventsChan <- inotify.Event{Name: path, Op: inotify.Create}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Println(err)
+	}
+}
 
-		logger.Printf("Running ffmpeg with arguments %v\n", commandArgs)
-		if err := exec.Command("/usr/bin/ffmpeg", commandArgs...).Run(); err != nil {
-			logger.Println(err)
-			continue
-		}
+// The inotify events that mean a file has been written or moved into the watched directory,
+// or is gone before it settled
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE
 
-		// delete the old video
-		if err := os.Remove(video); err != nil {
-			logger.Println(err)
-			continue
+// Starts watching a root and all of its subdirectories for new .mkv files and writes the events to the channel
+// until the context is cancelled
+func watchDirectory(ctx context.Context, root *Root, eventsChan chan<- inotify.Event) error {
+	watcher, err := newWatcher(root)
+	if err != nil {
+		return err
+	}
+	go findInitialFiles(ctx, root, eventsChan)
+
+	// overflows that happen while a rescan is running are handled by a single rescan after it
+	rescanChan := make(chan struct{}, 1)
+	go rescanDirectory(ctx, watcher, root, eventsChan, rescanChan)
+
+	logger.Printf("Started watching for video files at %s\n", root.Path)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				if err := watcher.Close(); err != nil {
+					logger.Println(err)
+				}
+				logger.Printf("Stopped watching %s\n", root.Path)
+				return
+			case ev := <-watcher.Events():
+				if !isAllowedFile(ev.Name) && !isAllowedFile(ev.OldName) {
+					continue
+				}
+
+				// files are done when they are closed after writing, moved in or were
+				// already there when their directory showed up. Renames are passed on
+				// so that queued files can be followed and removals so that settling files
+				// are forgotten. Polling only sees writes
+				if ev.Op&(inotify.CloseWrite|inotify.MovedTo|inotify.Create|inotify.Rename|inotify.Write|inotify.Remove) == 0 {
+					continue
+				}
+				if ev.Op&inotify.Remove == 0 {
+					logger.Printf("Found %s (%v)\n", ev.Name, ev.Op)
+					filesSeen.Inc()
+				}
+				select {
+				case eventsChan <- ev:
+				case <-ctx.Done():
+					// settleFiles may be gone, the watcher is closed on the next loop
+				}
+			case err := <-watcher.Errors():
+				logger.Println(err)
+				if err == inotify.ErrEventOverflow {
+					inotifyOverflows.Inc()
+					select {
+					case rescanChan <- struct{}{}:
+					default:
+					}
+				}
+			}
 		}
+	}()
 
-		logger.Printf("Finished %s\n", output)
-	}
+	return nil
 }
 
-// Checks if a specific codec is in the list
-func hasCodec(codec string, codecs []string) bool {
-	for _, c := range codecs {
-		if c == codec {
-			return true
+// Creates a watcher for the root with its backend and starts watching it. fanotify falls
+// back to inotify when it isn't permitted or supported
+func newWatcher(root *Root) (watch.Watcher, error) {
+	watchDir := root.Path
+	backend, err := watch.ParseBackend(root.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend == watch.Auto {
+		if backend, err = watch.Detect(watchDir); err != nil {
+			return nil, err
 		}
 	}
 
-	return false
-}
+	if backend == watch.Fanotify {
+		watcher, err := watch.NewFanotify(watchMask)
+		if err == nil {
+			if err = watcher.AddRecursive(watchDir); err == nil {
+				logger.Printf("Watching %s with %s\n", watchDir, backend)
+				return watcher, nil
+			}
+			watcher.Close()
+		}
+		logger.Printf("Can't use fanotify for %s, falling back to inotify: %v\n", watchDir, err)
+		backend = watch.Inotify
+	}
 
-// Gets a lit of codecs that are used by the video file
-func getCodecs(filename string) ([]string, error) {
-	probeCommand := fmt.Sprintf("ffprobe -v error -show_format -show_streams \"%s\" | grep codec_name", filename)
-	output, err := exec.Command("/bin/sh", "-c", probeCommand).Output()
-	if err != nil {
+	var watcher watch.Watcher
+	if backend == watch.Poll {
+		watcher = watch.NewPoller(*pollInterval)
+	} else if watcher, err = watch.NewInotify(watchMask); err != nil {
 		return nil, err
 	}
 
-	codecs := make([]string, 0, 2)
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	regex := regexp.MustCompile("codec_name=(.+)$")
-	for _, l := range lines {
-		matches := regex.FindAllStringSubmatch(l, -1)
-		if matches == nil {
-			return nil, errors.New("Could not parse codecs")
-		}
-		codecs = append(codecs, strings.TrimSpace(matches[0][1]))
+	if err := watcher.AddRecursive(watchDir); err != nil {
+		watcher.Close()
+		return nil, err
 	}
+	logger.Printf("Watching %s with %s\n", watchDir, backend)
+	return watcher, nil
+}
 
-	return codecs, nil
+// Walks the directory again every time the channel fires so files whose events were dropped
+// are still converted. Files that are already queued or converted are filtered out by the
+// job store. Runs in separate goroutine
+func rescanDirectory(ctx context.Context, watcher watch.Watcher, root *Root, eventsChan chan<- inotify.Event, rescanChan <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rescanChan:
+			logger.Printf("Missed events in %s, rescanning it\n", root.Path)
+			rescans.Inc()
+
+			// directories created while events were being dropped aren't watched yet
+			if err := watcher.AddRecursive(root.Path); err != nil {
+				logger.Println(err)
+			}
+			findInitialFiles(ctx, root, eventsChan)
+		}
+	}
 }
 
-func isAllowedFile(filename string) bool {
-	for _, ext := range allowedFileTypes {
-		if filepath.Ext(filename) == ext {
+// Checks if a specific codec is in the list
+func hasCodec(codec string, codecs []string) bool {
+	for _, c := range codecs {
+		if c == codec {
 			return true
 		}
 	}
+
 	return false
 }
+
+// Checks if the file is in one of the roots and should be converted
+func isAllowedFile(filename string) bool {
+	root := currentConfig().rootFor(filename)
+	return root != nil && root.allows(filename)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/simonjm/hawkeye/metrics"
+)
+
+// The stages of a conversion that can fail, used as the stage label of failedFiles
+const (
+	stageProbe   = "probe"
+	stageConvert = "convert"
+	stageVerify  = "verify"
+	stageOutput  = "output"
+	stageCodec   = "codec"
+)
+
+var (
+	filesSeen        = metrics.NewCounter("hawkeye_files_seen_total", "Video files seen by the watcher.")
+	filesQueued      = metrics.NewCounter("hawkeye_files_queued_total", "Video files queued for conversion.")
+	filesConverted   = metrics.NewCounter("hawkeye_files_converted_total", "Video files converted successfully.")
+	filesUnsupported = metrics.NewCounter("hawkeye_files_unsupported_total", "Video files skipped because of an unsupported codec.")
+	filesFailed      = metrics.NewCounter("hawkeye_files_failed_total", "Video files that failed to convert.", "stage")
+	filesMoved       = metrics.NewCounter("hawkeye_files_moved_to_failed_total", "Video files moved to the failed directory.")
+	jobRetries       = metrics.NewCounter("hawkeye_retries_total", "Failed conversions that were put aside to be retried.")
+
+	conversionSeconds = metrics.NewHistogram("hawkeye_conversion_duration_seconds",
+		"How long successful conversions took.", metrics.ExponentialBuckets(1, 2, 14))
+	conversionBytes = metrics.NewHistogram("hawkeye_conversion_bytes",
+		"Size of the source files of successful conversions.", metrics.ExponentialBuckets(16<<20, 2, 12))
+
+	inotifyOverflows = metrics.NewCounter("hawkeye_inotify_overflows_total", "Times the inotify event queue overflowed.")
+	rescans          = metrics.NewCounter("hawkeye_rescans_total", "Times the watched directories were walked again after missing events.")
+
+	_ = metrics.NewGaugeFunc("hawkeye_queue_depth", "Jobs waiting for a worker.", func() float64 {
+		return float64(store.count(jobQueued))
+	})
+	_ = metrics.NewGaugeFunc("hawkeye_retries_waiting", "Jobs waiting to be retried.", func() float64 {
+		return float64(store.count(jobRetrying))
+	})
+	_ = metrics.NewGaugeFunc("hawkeye_workers_busy", "Workers that are running a job.", func() float64 {
+		return float64(pool.busy())
+	})
+)
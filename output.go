@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ffmpeg writes into this directory inside of the output directory so that nothing shows
+// up under the real name until it is complete. Being on the same filesystem means the
+// finished file can be renamed into place
+func stagingDir(outDir string) string {
+	return filepath.Join(outDir, ".hawkeye-tmp")
+}
+
+// Removes anything left behind in the staging directory by earlier runs
+func cleanStagingDir(outDir string) error {
+	dir := stagingDir(outDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// Returns where a video of the root is converted to. It keeps its path relative to the root
+// so videos with the same name in different directories don't end up in the same file
+func (r *Root) outputPath(video string) string {
+	rel, err := filepath.Rel(r.Path, video)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(video)
+	}
+	return filepath.Join(r.OutDir, strings.TrimSuffix(rel, filepath.Ext(rel))+".mp4")
+}
+
+// Creates a uniquely named temporary file in the staging directory of the output directory.
+// The name keeps the extension so ffmpeg still knows which format to write
+func createTempOutput(outDir, output string) (string, error) {
+	file, err := os.CreateTemp(stagingDir(outDir), "*-"+filepath.Base(output))
+	if err != nil {
+		return "", err
+	}
+
+	name := file.Name()
+	if err := file.Close(); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// The error of videos whose output is already taken by another video
+var errOutputExists = errors.New("output already exists")
+
+// Flushes the temporary file to disk and moves it to the real output name. An existing
+// output is only replaced if replace is set, otherwise errOutputExists is returned
+func commitOutput(tmp, output string, replace bool) error {
+	if err := syncPath(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+
+	if replace {
+		if err := os.Rename(tmp, output); err != nil {
+			return err
+		}
+	} else {
+		// unlike a rename, linking fails if the output is already there
+		err := os.Link(tmp, output)
+		switch {
+		case os.IsExist(err):
+			return fmt.Errorf("%s: %w", output, errOutputExists)
+		case errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOSYS):
+			// network and FUSE filesystems often can't hard link, a rename has to do
+			if _, err := os.Lstat(output); err == nil {
+				return fmt.Errorf("%s: %w", output, errOutputExists)
+			}
+			if err := os.Rename(tmp, output); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			if err := os.Remove(tmp); err != nil {
+				return err
+			}
+		}
+	}
+
+	// make sure the rename itself survives a crash
+	return syncPath(filepath.Dir(output))
+}
+
+// Calls fsync on a file or directory
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Removes a temporary output that is no longer needed
+func removeTempOutput(tmp string) {
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		logger.Println(err)
+	}
+}
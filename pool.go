@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// The cause given to the context of a job that was cancelled through the API
+var errJobCancelled = errors.New("job cancelled")
+
+// Limits how many jobs the convertFiles workers run at once, lets them be paused and
+// resumed and keeps track of the running jobs so they can be cancelled
+type workerPool struct {
+	mu      sync.Mutex
+	paused  bool
+	size    int                                // How many jobs may run at once
+	workers int                                // How many convertFiles goroutines are running
+	changed chan struct{}                      // Closed when a job finishes or the pool is resumed or resized
+	running map[string]context.CancelCauseFunc // Map of running jobs (key: path of the video)
+}
+
+func newWorkerPool() *workerPool {
+	return &workerPool{
+		changed: make(chan struct{}),
+		running: make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// Wakes up the workers that are waiting to start a job. The caller must hold p.mu
+func (p *workerPool) broadcast() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Stops the workers from starting new jobs. Running jobs are left alone
+func (p *workerPool) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+}
+
+// Lets the workers start new jobs again
+func (p *workerPool) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		p.paused = false
+		p.broadcast()
+	}
+}
+
+// Checks if the pool is paused
+func (p *workerPool) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Changes how many jobs may run at once. Running jobs are left to finish when the pool
+// shrinks. Returns how many workers have to be started for the pool to grow
+func (p *workerPool) resize(size int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.size = size
+	p.broadcast()
+
+	start := 0
+	if size > p.workers {
+		start = size - p.workers
+		p.workers = size
+	}
+	return start
+}
+
+// Checks if a worker should exit because the pool has shrunk. Workers that get true
+// must return
+func (p *workerPool) retire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers > p.size {
+		p.workers--
+		return true
+	}
+	return false
+}
+
+// The number of jobs that may run at once
+func (p *workerPool) limit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Blocks until the pool isn't paused and has room for another job, then claims the job
+// and records it as running so it can be cancelled. The returned func must be called once
+// it's done and is nil if the job couldn't be claimed, e.g. because another worker got it
+// first. Returns false if the context was cancelled first
+func (p *workerPool) start(ctx context.Context, video string, cancel context.CancelCauseFunc, claim func() bool) (func(), bool) {
+	for {
+		p.mu.Lock()
+		if ctx.Err() != nil {
+			p.mu.Unlock()
+			return nil, false
+		}
+		if !p.paused && len(p.running) < p.size {
+			// claiming under the lock means that only the worker that converts the job
+			// is ever recorded for it
+			if !claim() {
+				p.mu.Unlock()
+				return nil, true
+			}
+			p.running[video] = cancel
+			p.mu.Unlock()
+			return func() {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				delete(p.running, video)
+				cancel(nil)
+				p.broadcast()
+			}, true
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Cancels a running job. Returns false if the job isn't running
+func (p *workerPool) cancel(video string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cancel, ok := p.running[video]
+	if ok {
+		cancel(errJobCancelled)
+	}
+	return ok
+}
+
+// The number of jobs that are running
+func (p *workerPool) busy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.running)
+}
@@ -0,0 +1,147 @@
+// Package probe runs ffprobe against media files and decodes its JSON output.
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Path is the ffprobe binary that is run by Probe.
+var Path = "ffprobe"
+
+// Stream types reported by ffprobe in codec_type.
+const (
+	Video      = "video"
+	Audio      = "audio"
+	Subtitle   = "subtitle"
+	Data       = "data"
+	Attachment = "attachment"
+)
+
+// MediaInfo is the result of probing a media file.
+type MediaInfo struct {
+	Streams []Stream `json:"streams"`
+	Format  Format   `json:"format"`
+}
+
+// Stream describes a single stream inside of a container.
+type Stream struct {
+	Index         int               `json:"index"`
+	CodecName     string            `json:"codec_name"`
+	CodecLongName string            `json:"codec_long_name"`
+	CodecType     string            `json:"codec_type"`
+	Profile       string            `json:"profile"`
+	PixFmt        string            `json:"pix_fmt"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout"`
+	SampleRate    int               `json:"sample_rate,string"`
+	BitRate       int64             `json:"bit_rate,string"`
+	Duration      float64           `json:"duration,string"`
+	Disposition   map[string]int    `json:"disposition"`
+	Tags          map[string]string `json:"tags"`
+}
+
+// Format describes the container of a media file.
+type Format struct {
+	Filename   string            `json:"filename"`
+	NbStreams  int               `json:"nb_streams"`
+	FormatName string            `json:"format_name"`
+	Duration   float64           `json:"duration,string"`
+	Size       int64             `json:"size,string"`
+	BitRate    int64             `json:"bit_rate,string"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// Language returns the language tag of the stream or an empty string if it isn't set.
+func (s Stream) Language() string {
+	return s.Tags["language"]
+}
+
+// Title returns the title tag of the stream or an empty string if it isn't set.
+func (s Stream) Title() string {
+	return s.Tags["title"]
+}
+
+// IsDefault reports whether the stream has the default disposition.
+func (s Stream) IsDefault() bool {
+	return s.Disposition["default"] == 1
+}
+
+// StreamsOfType returns all the streams with the given codec type.
+func (m *MediaInfo) StreamsOfType(codecType string) []Stream {
+	var streams []Stream
+	for _, s := range m.Streams {
+		if s.CodecType == codecType {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// Codecs returns the codec names of all the streams with the given codec type.
+func (m *MediaInfo) Codecs(codecType string) []string {
+	var codecs []string
+	for _, s := range m.StreamsOfType(codecType) {
+		codecs = append(codecs, s.CodecName)
+	}
+	return codecs
+}
+
+// Args returns the ffprobe arguments used to probe filename.
+func Args(filename string) []string {
+	return []string{"-v", "error", "-print_format", "json", "-show_streams", "-show_format", filename}
+}
+
+// Probe runs ffprobe on filename and decodes the result. ffprobe is killed if the
+// context is done before it exits.
+func Probe(ctx context.Context, filename string) (*MediaInfo, error) {
+	return Prober{}.Probe(ctx, filename)
+}
+
+// Prober runs a specific ffprobe binary in a specific environment.
+type Prober struct {
+	Path string   // ffprobe binary, Path is used if empty
+	Env  []string // extra environment variables in the form key=value
+	Dir  string   // working directory, the current one if empty
+
+	// Stderr receives what ffprobe writes to stderr, if set
+	Stderr io.Writer
+}
+
+// Probe runs ffprobe on filename and decodes the result. ffprobe is killed if the
+// context is done before it exits.
+func (p Prober) Probe(ctx context.Context, filename string) (*MediaInfo, error) {
+	path := p.Path
+	if path == "" {
+		path = Path
+	}
+
+	cmd := exec.CommandContext(ctx, path, Args(filename)...)
+	if len(p.Env) > 0 {
+		cmd.Env = append(os.Environ(), p.Env...)
+	}
+	cmd.Dir = p.Dir
+	cmd.Stderr = p.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe %s: %w", filename, err)
+	}
+
+	return Parse(output)
+}
+
+// Parse decodes the JSON output of ffprobe.
+func Parse(data []byte) (*MediaInfo, error) {
+	info := new(MediaInfo)
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far along ffmpeg is with a conversion, taken from the output of -progress
+type progress struct {
+	Percent   float64   `json:"percent"`       // how much of the source has been converted, 0 if the duration isn't known
+	OutTime   float64   `json:"out_time"`      // seconds of the output that have been written
+	Speed     float64   `json:"speed"`         // how many times faster than real time ffmpeg is going
+	FPS       float64   `json:"fps"`           // frames converted per second
+	TotalSize int64     `json:"total_size"`    // bytes of the output that have been written
+	ETA       float64   `json:"eta,omitempty"` // seconds until the conversion is done
+	Updated   time.Time `json:"updated"`
+}
+
+// Reads the key=value blocks that ffmpeg writes with -progress and calls update at the
+// end of each block. duration is the length of the source in seconds, if it is known
+func readProgress(r io.Reader, duration float64, update func(progress)) error {
+	var p progress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// out_time_ms is in microseconds as well
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				p.OutTime = float64(us) / 1e6
+			}
+		case "speed":
+			p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "fps":
+			p.FPS, _ = strconv.ParseFloat(value, 64)
+		case "total_size":
+			p.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+		case "progress":
+			p.Percent, p.ETA = 0, 0
+			if duration > 0 {
+				p.Percent = math.Min(100, p.OutTime/duration*100)
+				if value == "end" {
+					p.Percent = 100
+				} else if p.Speed > 0 && p.OutTime < duration {
+					p.ETA = (duration - p.OutTime) / p.Speed
+				}
+			}
+			p.Updated = time.Now()
+			update(p)
+		}
+	}
+	return scanner.Err()
+}
+
+// Describes the progress for the log
+func (p progress) String() string {
+	s := fmt.Sprintf("%s written at %.2fx", time.Duration(p.OutTime*float64(time.Second)).Round(time.Second), p.Speed)
+	if p.Percent > 0 {
+		s = fmt.Sprintf("%.1f%%, %s", p.Percent, s)
+	}
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", %s left", time.Duration(p.ETA*float64(time.Second)).Round(time.Second))
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadProgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		duration float64
+		want     []progress
+	}{
+		{
+			name: "blocks",
+			input: "out_time_us=2000000\nfps=24.5\nspeed=2x\ntotal_size=1024\nprogress=continue\n" +
+				"out_time_us=6000000\nspeed=2x\nprogress=continue\n",
+			duration: 10,
+			want: []progress{
+				{Percent: 20, OutTime: 2, Speed: 2, FPS: 24.5, TotalSize: 1024, ETA: 4},
+				{Percent: 60, OutTime: 6, Speed: 2, FPS: 24.5, TotalSize: 1024, ETA: 2},
+			},
+		},
+		{
+			name:     "out_time_ms is in microseconds",
+			input:    "out_time_ms=5000000\nspeed=1x\nprogress=continue\n",
+			duration: 10,
+			want:     []progress{{Percent: 50, OutTime: 5, Speed: 1, ETA: 5}},
+		},
+		{
+			name:     "end",
+			input:    "out_time_us=9900000\nspeed=3x\nprogress=end\n",
+			duration: 10,
+			want:     []progress{{Percent: 100, OutTime: 9.9, Speed: 3}},
+		},
+		{
+			name:     "unknown duration",
+			input:    "out_time_us=3000000\nspeed=1.5x\nprogress=continue\n",
+			duration: 0,
+			want:     []progress{{OutTime: 3, Speed: 1.5}},
+		},
+		{
+			name:     "output longer than the source",
+			input:    "out_time_us=12000000\nspeed=1x\nprogress=continue\n",
+			duration: 10,
+			want:     []progress{{Percent: 100, OutTime: 12, Speed: 1}},
+		},
+		{
+			name:     "bad values",
+			input:    "out_time_us=N/A\nspeed=N/A\n\ngarbage\nprogress=continue\n",
+			duration: 10,
+			want:     []progress{{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []progress
+			err := readProgress(strings.NewReader(tt.input), tt.duration, func(p progress) {
+				if p.Updated.IsZero() {
+					t.Error("Updated isn't set")
+				}
+				got = append(got, p)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d updates, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				got[i].Updated = tt.want[i].Updated
+				if got[i] != tt.want[i] {
+					t.Errorf("update %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/simonjm/hawkeye/inotify"
+)
+
+// The config that is in effect. It is replaced as a whole when the config file is reloaded
+// and never changed afterwards, so running jobs keep the settings they started with
+var (
+	configMu     sync.RWMutex
+	activeConfig *Config
+)
+
+// Flags that were passed on the command line, they win over the config file
+var setFlags = make(map[string]bool)
+
+// Returns the config that is in effect
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return activeConfig
+}
+
+func setConfig(config *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	activeConfig = config
+}
+
+// Reads the config file and fills in everything it doesn't set from the flags
+func readConfig() (*Config, error) {
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if setFlags["max-jobs"] || config.MaxJobs == 0 {
+		config.MaxJobs = *maxJobs
+	}
+	if config.MaxJobs < 1 {
+		return nil, fmt.Errorf("max_jobs must be at least 1 but is %d", config.MaxJobs)
+	}
+	if setFlags["log-file"] || config.LogFile == "" {
+		config.LogFile = *logFile
+	}
+	if setFlags["ffmpeg"] || config.FFmpeg == "" {
+		config.FFmpeg = *ffmpegPath
+	}
+	if setFlags["ffprobe"] || config.FFprobe == "" {
+		config.FFprobe = *ffprobePath
+	}
+	if setFlags["job-logs"] || config.JobLogs == "" {
+		config.JobLogs = *jobLogs
+	}
+	if err := config.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if len(config.Extensions) == 0 {
+		config.Extensions = defaultExtensions
+	}
+
+	// the directories passed as arguments are watched along with the roots in the config file
+	if config.Roots, err = setupRoots(config, flag.Args()); err != nil {
+		return nil, err
+	}
+	if len(config.Roots) == 0 {
+		return nil, errors.New("nothing to watch, pass a directory as the last argument or list roots in the config file")
+	}
+
+	if err := checkTools(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Creates the output directories of the roots. Clean empties their staging directories,
+// which must only be done before any jobs have started
+func prepareOutDirs(config *Config, clean bool) error {
+	for _, root := range config.Roots {
+		if clean {
+			if err := os.MkdirAll(root.OutDir, 0755); err != nil {
+				return err
+			}
+			if err := cleanStagingDir(root.OutDir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(stagingDir(root.OutDir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The log file that the logger writes to, if any
+var logCloser io.Closer
+
+// Points the logger at the file, or stdout if the path is empty, and closes the file it
+// was writing to before. Reopening the same file lets it be rotated
+func openLog(path string) error {
+	var w io.Writer = os.Stdout
+	var closer io.Closer
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		w, closer = file, file
+	}
+
+	logger.SetOutput(w)
+	closeLog()
+	logCloser = closer
+	return nil
+}
+
+func closeLog() {
+	if logCloser != nil {
+		logCloser.Close()
+		logCloser = nil
+	}
+}
+
+// Reads the config file again and applies it. Queued and running jobs are left alone and
+// the old config stays in effect if the new one is invalid
+func reloadConfig(watchers *rootWatchers, startWorkers func(int)) {
+	logger.Println("Reloading the config")
+	config, err := readConfig()
+	if err != nil {
+		logger.Printf("Keeping the old config: %v\n", err)
+		return
+	}
+	if err := prepareOutDirs(config, false); err != nil {
+		logger.Printf("Keeping the old config: %v\n", err)
+		return
+	}
+	if err := config.setupCgroup(); err != nil {
+		logger.Printf("Keeping the old config: %v\n", err)
+		return
+	}
+
+	if err := openLog(config.LogFile); err != nil {
+		logger.Println(err)
+	}
+
+	old := currentConfig()
+	for _, root := range append(old.Roots, old.removed...) {
+		if r := config.rootFor(root.Path); r == nil || r.Path != root.Path {
+			config.removed = append(config.removed, root)
+		}
+	}
+	setConfig(config)
+
+	if config.MaxJobs != old.MaxJobs {
+		logger.Printf("Running %d jobs at once instead of %d\n", config.MaxJobs, old.MaxJobs)
+	}
+	startWorkers(pool.resize(config.MaxJobs))
+
+	if err := watchers.update(config.Roots); err != nil {
+		logger.Println(err)
+	}
+	logger.Println("Reloaded the config")
+}
+
+// Keeps a watcher running for every root
+type rootWatchers struct {
+	ctx        context.Context
+	eventsChan chan<- inotify.Event
+	watching   map[string]*watchedRoot // Map of running watchers (key: path of the root)
+}
+
+type watchedRoot struct {
+	backend string
+	cancel  context.CancelFunc
+}
+
+func newRootWatchers(ctx context.Context, eventsChan chan<- inotify.Event) *rootWatchers {
+	return &rootWatchers{ctx: ctx, eventsChan: eventsChan, watching: make(map[string]*watchedRoot)}
+}
+
+// Starts watching roots that are new or have a different backend and stops watching the
+// ones that are gone. Roots that were already watched are searched again for files that
+// their new rules allow. Returns the first error, the other roots are still updated
+func (w *rootWatchers) update(roots []*Root) error {
+	wanted := make(map[string]*Root)
+	for _, root := range roots {
+		wanted[root.Path] = root
+	}
+
+	for path, watched := range w.watching {
+		if root, ok := wanted[path]; !ok || root.Backend != watched.backend {
+			watched.cancel()
+			delete(w.watching, path)
+		}
+	}
+
+	var firstErr error
+	for _, root := range roots {
+		if _, ok := w.watching[root.Path]; ok {
+			go findInitialFiles(w.ctx, root, w.eventsChan)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(w.ctx)
+		if err := watchDirectory(ctx, root, w.eventsChan); err != nil {
+			cancel()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		w.watching[root.Path] = &watchedRoot{backend: root.Backend, cancel: cancel}
+	}
+	return firstErr
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides how often and how soon videos are converted again after a transient failure
+type RetryPolicy struct {
+	Attempts   int           `yaml:"attempts"`    // how many times a video is tried before it is moved to the failed directory
+	Backoff    time.Duration `yaml:"backoff"`     // wait before the first retry, doubled after each one
+	MaxBackoff time.Duration `yaml:"max_backoff"` // longest wait between retries
+	Jitter     float64       `yaml:"jitter"`      // fraction of the wait that is random, e.g. 0.2 for up to 20% more or less
+}
+
+// Used for everything the config file doesn't set
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    time.Minute,
+	MaxBackoff: time.Hour,
+	Jitter:     0.2,
+}
+
+func (p RetryPolicy) validate() error {
+	switch {
+	case p.Attempts < 1:
+		return fmt.Errorf("retry attempts must be at least 1 but is %d", p.Attempts)
+	case p.Backoff < 0 || p.MaxBackoff < 0:
+		return errors.New("retry backoff can't be negative")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("retry jitter must be between 0 and 1 but is %v", p.Jitter)
+	}
+	return nil
+}
+
+// How long to wait before trying again after the attempt failed, counting from 1
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	// without a max the delay keeps doubling, short of overflowing
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || d < p.MaxBackoff) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// Failures are either worth retrying or will happen again no matter how often the
+// video is converted
+const (
+	failTransient = "transient"
+	failPermanent = "permanent"
+)
+
+// The error of videos that have a stream the profile can't handle
+var errUnsupportedCodec = errors.New("codec not supported")
+
+// What ffmpeg and ffprobe say about sources that are broken or not videos at all
+var corruptInputErrors = []string{
+	"Invalid data found when processing input",
+	"moov atom not found",
+	"EBML header parsing failed",
+	"could not parse ffprobe output",
+}
+
+// Decides if a failure is worth retrying. Unsupported codecs, corrupt sources and outputs
+// that are taken are permanent, crashes, full disks and anything else that we can't tell apart are transient
+func classifyFailure(err error, stderr string) string {
+	if errors.Is(err, errUnsupportedCodec) || errors.Is(err, errOutputExists) {
+		return failPermanent
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && !exitErr.Exited() {
+		// killed by a signal, e.g. the OOM killer
+		return failTransient
+	}
+
+	for _, s := range corruptInputErrors {
+		if strings.Contains(err.Error(), s) || strings.Contains(stderr, s) {
+			return failPermanent
+		}
+	}
+	return failTransient
+}
+
+// Queues the videos that are waiting to be retried once their time has come, until the
+// context is cancelled. Runs in separate goroutine
+func retryJobs(ctx context.Context, videosChan chan<- string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, video := range store.dueRetries(now) {
+				logger.Printf("Retrying %s\n", video)
+				select {
+				case videosChan <- video:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// The directory that videos of the root are moved to when they can't be converted
+func (r *Root) failedDir() string {
+	return r.dir(r.FailedDir)
+}
+
+// Why a video was moved to the failed directory, written next to it
+type failureRecord struct {
+	Source   string    `json:"source"`
+	Stage    string    `json:"stage"`
+	Class    string    `json:"class"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Stderr   string    `json:"stderr,omitempty"`
+	Log      string    `json:"log,omitempty"`
+	Failed   time.Time `json:"failed"`
+}
+
+// Moves the video into the failed directory of the root, keeping its path relative to
+// the root, along with a .json file that explains why. Returns the new path
+func quarantine(root *Root, j job, record failureRecord) (string, error) {
+	rel, err := filepath.Rel(root.Path, j.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(j.Path)
+	}
+
+	dest := filepath.Join(root.failedDir(), rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	// don't replace a video that failed before under the same name
+	if _, err := os.Lstat(dest); err == nil {
+		dest = filepath.Join(filepath.Dir(dest), fmt.Sprintf("%d-%s", j.ID, filepath.Base(dest)))
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(dest+".json", append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+
+	// the failed directory may be on another filesystem
+	if err := moveFile(j.Path, dest); err != nil {
+		os.Remove(dest + ".json")
+		return "", err
+	}
+	return dest, nil
+}
+
+// Moves a video that was moved to the failed directory back to where it was found and
+// removes the .json file that explains why it failed
+func restoreFailed(j job) error {
+	if _, err := os.Lstat(j.Path); err == nil {
+		return fmt.Errorf("%s is in the way of moving %s back", j.Path, j.Moved)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0755); err != nil {
+		return err
+	}
+	if err := moveFile(j.Moved, j.Path); err != nil {
+		return err
+	}
+	if err := os.Remove(j.Moved + ".json"); err != nil && !os.IsNotExist(err) {
+		logger.Println(err)
+	}
+	logger.Printf("Moved %s back to %s\n", j.Moved, j.Path)
+	return nil
+}
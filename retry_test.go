@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first", RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Hour}, 1, time.Minute},
+		{"doubled", RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Hour}, 2, 2 * time.Minute},
+		{"doubled again", RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Hour}, 4, 8 * time.Minute},
+		{"capped", RetryPolicy{Backoff: time.Minute, MaxBackoff: 5 * time.Minute}, 4, 5 * time.Minute},
+		{"capped after many attempts", RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Hour}, 100, time.Hour},
+		{"no cap", RetryPolicy{Backoff: time.Second}, 3, 4 * time.Second},
+		{"no cap doesn't overflow", RetryPolicy{Backoff: time.Second}, 100, time.Second << 33},
+		{"no backoff", RetryPolicy{MaxBackoff: time.Hour}, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.delay(tt.attempt); got != tt.want {
+				t.Errorf("delay(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Minute, MaxBackoff: time.Hour, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if got := p.delay(2); got < 96*time.Second || got > 144*time.Second {
+			t.Fatalf("delay(2) = %v, want between 96s and 144s", got)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		wantErr bool
+	}{
+		{"default", defaultRetryPolicy, false},
+		{"no attempts", RetryPolicy{Attempts: 0}, true},
+		{"negative backoff", RetryPolicy{Attempts: 1, Backoff: -time.Second}, true},
+		{"negative max backoff", RetryPolicy{Attempts: 1, MaxBackoff: -time.Second}, true},
+		{"too much jitter", RetryPolicy{Attempts: 1, Jitter: 1.5}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		stderr string
+		want   string
+	}{
+		{"unsupported codec", errUnsupportedCodec, "", failPermanent},
+		{"output taken", fmt.Errorf("a.mp4: %w", errOutputExists), "", failPermanent},
+		{"corrupt source", errors.New("exit status 1"), "a.mkv: Invalid data found when processing input", failPermanent},
+		{"corrupt source in the error", errors.New("could not parse ffprobe output: EOF"), "", failPermanent},
+		{"full disk", errors.New("exit status 1"), "No space left on device", failTransient},
+		{"unknown", errors.New("exit status 1"), "", failTransient},
+	}
+
+	// killed by a signal, even if the source looked broken
+	killed := exec.Command("sh", "-c", "kill -KILL $$").Run()
+	tests = append(tests, struct {
+		name   string
+		err    error
+		stderr string
+		want   string
+	}{"killed", killed, "Invalid data found when processing input", failTransient})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFailure(tt.err, tt.stderr); got != tt.want {
+				t.Errorf("classifyFailure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
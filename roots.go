@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/simonjm/hawkeye/watch"
+)
+
+// The file types that are converted when neither the root nor the config file list any
+var defaultExtensions = []string{".mkv", ".m4v"}
+
+// Builds the roots from the config file and the directories passed on the command line and
+// fills in the defaults from the flags
+func setupRoots(config *Config, dirs []string) ([]*Root, error) {
+	all := append([]*Root(nil), config.Roots...)
+	for _, dir := range dirs {
+		all = append(all, &Root{Path: dir})
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range all {
+		if r == nil || r.Path == "" {
+			return nil, fmt.Errorf("root %d has no path", i+1)
+		}
+
+		path, err := filepath.Abs(r.Path)
+		if err != nil {
+			return nil, err
+		}
+		// events and jobs use the real path of the files so each file only has one name
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		r.Path = path
+		if seen[r.Path] {
+			return nil, fmt.Errorf("%s is listed more than once", r.Path)
+		}
+		seen[r.Path] = true
+
+		if r.OutDir == "" {
+			r.OutDir = *outDir
+		}
+		if r.OutDir == "" {
+			return nil, fmt.Errorf("%s: out_dir or --out-dir is required", r.Path)
+		}
+		if r.OutDir, err = filepath.Abs(r.OutDir); err != nil {
+			return nil, err
+		}
+
+		if len(r.Extensions) == 0 {
+			r.Extensions = append([]string(nil), config.Extensions...)
+		}
+		for j, ext := range r.Extensions {
+			if !strings.HasPrefix(ext, ".") {
+				r.Extensions[j] = "." + ext
+			}
+		}
+
+		for _, pattern := range append(append([]string(nil), r.Include...), r.Exclude...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: bad glob %q: %v", r.Path, pattern, err)
+			}
+		}
+
+		if r.Profile == "" {
+			r.Profile = *profileName
+		}
+		if r.profile, err = config.profile(r.Profile); err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Path, err)
+		}
+
+		if r.Backend == "" {
+			r.Backend = *watchBackend
+		}
+		if _, err := watch.ParseBackend(r.Backend); err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Path, err)
+		}
+
+		if r.FailedDir == "" {
+			r.FailedDir = "failed"
+		}
+		if r.Source == "" {
+			r.Source = sourceDelete
+		}
+		if r.ArchiveDir == "" {
+			r.ArchiveDir = "archive"
+		}
+		if r.TrashDir == "" {
+			r.TrashDir = "trash"
+		}
+		if r.TrashRetention == 0 {
+			r.TrashRetention = defaultTrashRetention
+		}
+		switch r.Source {
+		case sourceDelete, sourceArchive, sourceLink, sourceKeep, sourceTrash:
+		default:
+			return nil, fmt.Errorf("%s: unknown source %q, expected delete, archive, link, keep or trash", r.Path, r.Source)
+		}
+		for _, dir := range []string{r.FailedDir, r.ArchiveDir, r.TrashDir} {
+			if filepath.Clean(r.dir(dir)) == r.Path {
+				return nil, fmt.Errorf("%s: %s can't be the root itself", r.Path, dir)
+			}
+		}
+
+		for _, action := range r.PostActions {
+			if len(action) == 0 {
+				return nil, fmt.Errorf("%s: post action is empty", r.Path)
+			}
+		}
+	}
+
+	return all, nil
+}
+
+// Returns the root that the path is in, the deepest one if roots are nested
+func (c *Config) rootFor(path string) *Root {
+	var found *Root
+	for _, r := range c.Roots {
+		if isInDir(r.Path, path) && (found == nil || len(r.Path) > len(found.Path)) {
+			found = r
+		}
+	}
+	return found
+}
+
+// Returns the root to convert a video with. Roots that were removed when the config was
+// reloaded are still used for the videos that were queued in them
+func (c *Config) jobRoot(path string) *Root {
+	if root := c.rootFor(path); root != nil {
+		return root
+	}
+
+	var found *Root
+	for _, r := range c.removed {
+		if isInDir(r.Path, path) && (found == nil || len(r.Path) > len(found.Path)) {
+			found = r
+		}
+	}
+	return found
+}
+
+// Checks if path is dir or inside of it
+func isInDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Returns the absolute path of the file with the symlinks in its directories resolved,
+// the same way the paths of the roots are. The file itself may be a symlink
+func canonicalPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// Checks if the file is one that should be converted
+func (r *Root) allows(path string) bool {
+	if isInDir(stagingDir(r.OutDir), path) || isInDir(r.failedDir(), path) {
+		return false
+	}
+	if r.Source != sourceDelete && (isInDir(r.dir(r.ArchiveDir), path) || isInDir(r.dir(r.TrashDir), path)) {
+		return false
+	}
+
+	allowed := false
+	for _, ext := range r.Extensions {
+		if strings.EqualFold(filepath.Ext(path), ext) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	rel, err := filepath.Rel(r.Path, path)
+	if err != nil {
+		return false
+	}
+	if len(r.Include) > 0 && !matchesAny(r.Include, rel) {
+		return false
+	}
+	if matchesAny(r.Exclude, rel) {
+		return false
+	}
+
+	// videos that were kept after they were converted
+	return r.Source == sourceDelete || !hasMarker(path)
+}
+
+// Checks the path relative to the root against the globs. Globs without a slash are
+// matched against every part of the path, so "Extras" excludes any directory called that
+func matchesAny(patterns []string, rel string) bool {
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			if ok, _ := filepath.Match(pattern, rel); ok {
+				return true
+			}
+			continue
+		}
+
+		for _, part := range parts {
+			if ok, _ := filepath.Match(pattern, part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Runs the post actions of the root once a video has been converted. {source} and {output}
+// in the arguments are replaced with the paths of the video and what it was converted to
+func (r *Root) runPostActions(ctx context.Context, video, output string) {
+	replacer := strings.NewReplacer("{source}", video, "{output}", output)
+	for _, action := range r.PostActions {
+		args := make([]string, len(action))
+		for i, arg := range action {
+			args[i] = replacer.Replace(arg)
+		}
+
+		logger.Printf("Running post action %v\n", args)
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			logger.Printf("Post action %v failed: %v: %s\n", args, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{"no patterns", nil, "Movie.mkv", false},
+		{"file name", []string{"*.sample.mkv"}, "Movie/Movie.sample.mkv", true},
+		{"directory anywhere", []string{"Extras"}, "Show/Season 1/Extras/a.mkv", true},
+		{"part must match as a whole", []string{"Extra"}, "Show/Extras/a.mkv", false},
+		{"glob in a part", []string{"Season ?"}, "Show/Season 1/a.mkv", true},
+		{"case sensitive", []string{"extras"}, "Show/Extras/a.mkv", false},
+		{"path", []string{"Show/*/a.mkv"}, "Show/Season 1/a.mkv", true},
+		{"path only matches from the root", []string{"Season 1/a.mkv"}, "Show/Season 1/a.mkv", false},
+		{"path doesn't cross slashes", []string{"Show/*.mkv"}, "Show/Season 1/a.mkv", false},
+		{"any of several", []string{"Extras", "*.part"}, "Show/a.mkv.part", true},
+		{"bad pattern", []string{"[a"}, "a.mkv", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesAny(tt.patterns, tt.rel); got != tt.want {
+				t.Errorf("matchesAny(%q, %q) = %v, want %v", tt.patterns, tt.rel, got, tt.want)
+			}
+		})
+	}
+}
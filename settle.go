@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simonjm/hawkeye/inotify"
+	"golang.org/x/sys/unix"
+)
+
+// A file that is waiting to settle before it gets queued
+type pendingFile struct {
+	size     int64
+	modTime  time.Time
+	deadline time.Time
+}
+
+// Holds files that come in through the channel until they have stopped changing for the
+// quiet period and then sends them on to be converted. Files that are renamed while they
+// settle or wait in the queue are followed. Files that are still settling when the context
+// is cancelled are found again on the next start. Runs in separate goroutine
+func settleFiles(ctx context.Context, eventsChan <-chan inotify.Event, videosChan chan<- string, quiet time.Duration) {
+	pending := make(map[string]*pendingFile)
+
+	interval := quiet / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-eventsChan:
+			if !ok {
+				return
+			}
+			path := ev.Name
+
+			if ev.Op&inotify.Remove == inotify.Remove {
+				if _, ok := pending[path]; ok {
+					logger.Printf("%s was removed before it settled\n", path)
+					delete(pending, path)
+				}
+				continue
+			}
+
+			if ev.Op&inotify.Rename == inotify.Rename && ev.OldName != "" {
+				if p, ok := pending[ev.OldName]; ok {
+					delete(pending, ev.OldName)
+					if isAllowedFile(path) {
+						logger.Printf("%s was renamed to %s\n", ev.OldName, path)
+						pending[path] = p
+					}
+					continue
+				}
+
+				if isAllowedFile(path) {
+					if state, ok := store.rename(ev.OldName, path); ok {
+						logger.Printf("%s was renamed to %s while it was %s\n", ev.OldName, path, state)
+						// jobs that wait to be retried are sent once their time has come
+						if state == jobQueued {
+							videosChan <- path
+						}
+						continue
+					}
+				}
+
+				if !isAllowedFile(path) {
+					continue
+				}
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				logger.Println(err)
+				delete(pending, path)
+				continue
+			}
+
+			if p, ok := pending[path]; ok {
+				// rescans find files that are already settling
+				if info.Size() == p.size && info.ModTime().Equal(p.modTime) {
+					continue
+				}
+				logger.Printf("%s changed, restarting the %v wait\n", path, quiet)
+			}
+			pending[path] = &pendingFile{
+				size:     info.Size(),
+				modTime:  info.ModTime(),
+				deadline: time.Now().Add(quiet),
+			}
+		case now := <-ticker.C:
+			for path, p := range pending {
+				if now.Before(p.deadline) {
+					continue
+				}
+
+				info, err := os.Stat(path)
+				if err != nil {
+					logger.Println(err)
+					delete(pending, path)
+					continue
+				}
+
+				if info.Size() != p.size || !info.ModTime().Equal(p.modTime) {
+					logger.Printf("%s is still being written to, restarting the %v wait\n", path, quiet)
+					p.size = info.Size()
+					p.modTime = info.ModTime()
+					p.deadline = now.Add(quiet)
+					continue
+				}
+
+				if isOpenForWriting(path) {
+					logger.Printf("%s is still open for writing, restarting the %v wait\n", path, quiet)
+					p.deadline = now.Add(quiet)
+					continue
+				}
+
+				delete(pending, path)
+				if !store.enqueue(path) {
+					logger.Printf("%s is already queued or converted\n", path)
+					continue
+				}
+				logger.Printf("Queuing %s\n", path)
+				filesQueued.Inc()
+				videosChan <- path
+			}
+		}
+	}
+}
+
+// Checks if any process has the file open for writing by looking through /proc.
+// Processes that we don't have permission to inspect are skipped
+func isOpenForWriting(filename string) bool {
+	target, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+
+	fdDirs, err := filepath.Glob("/proc/[0-9]*/fd")
+	if err != nil {
+		return false
+	}
+
+	for _, fdDir := range fdDirs {
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || link != target {
+				continue
+			}
+
+			fdInfo := filepath.Join(filepath.Dir(fdDir), "fdinfo", fd.Name())
+			if flags, ok := readFdFlags(fdInfo); ok && flags&unix.O_ACCMODE != unix.O_RDONLY {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Reads the open flags from a /proc/<pid>/fdinfo/<fd> file
+func readFdFlags(fdInfo string) (int, bool) {
+	contents, err := os.ReadFile(fdInfo)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+
+		flags, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "flags:")), 8, 64)
+		if err != nil {
+			return 0, false
+		}
+		return int(flags), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// What happens to a video once it has been converted
+const (
+	sourceDelete  = "delete"  // remove it
+	sourceArchive = "archive" // move it to the archive directory
+	sourceLink    = "link"    // hard link it into the archive directory and leave it in place
+	sourceKeep    = "keep"    // leave it in place
+	sourceTrash   = "trash"   // move it to the trash directory, which is purged after the retention period
+)
+
+// How long trashed videos are kept when the root doesn't say
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// Resolves a directory of the root that may be relative to it
+func (r *Root) dir(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.Path, path)
+}
+
+// Gets rid of or keeps the video after it was converted, depending on the root
+func disposeSource(root *Root, video, output string) error {
+	switch root.Source {
+	case sourceArchive:
+		dest, err := root.archivePath(root.ArchiveDir, video)
+		if err != nil {
+			return err
+		}
+		return moveFile(video, dest)
+	case sourceLink:
+		dest, err := root.archivePath(root.ArchiveDir, video)
+		if err != nil {
+			return err
+		}
+		// the archive may be on another filesystem, it then gets a copy
+		err = os.Link(video, dest)
+		if errors.Is(err, syscall.EXDEV) {
+			err = copyFile(video, dest)
+		}
+		if err != nil {
+			return err
+		}
+		return writeMarker(video, output)
+	case sourceKeep:
+		return writeMarker(video, output)
+	case sourceTrash:
+		dest, err := root.archivePath(root.TrashDir, video)
+		if err != nil {
+			return err
+		}
+		if err := writeTrashRecord(video, dest); err != nil {
+			return err
+		}
+		if err := moveFile(video, dest); err != nil {
+			os.Remove(trashRecordPath(dest))
+			return err
+		}
+		return nil
+	default:
+		return os.Remove(video)
+	}
+}
+
+// Returns where the video goes in the directory, keeping its path relative to the root,
+// and creates the directories on the way there. A file that is already there is left alone
+func (r *Root) archivePath(dir, video string) (string, error) {
+	rel, err := filepath.Rel(r.Path, video)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(video)
+	}
+
+	dest := filepath.Join(r.dir(dir), rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+	return dest, nil
+}
+
+// Renames the file, copying it if the destination is on another filesystem
+func moveFile(src, dest string) error {
+	err := os.Rename(src, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dest); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Copies the file to a destination that doesn't exist yet, keeping its mode and modification time
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	os.Chtimes(dest, info.ModTime(), info.ModTime())
+	return nil
+}
+
+// A marker is left next to videos that are kept after they were converted so that they
+// aren't converted again, even if the job journal is lost
+type marker struct {
+	Output    string    `json:"output"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	Converted time.Time `json:"converted"`
+}
+
+// The marker file of a video, hidden so it doesn't show up next to it
+func markerPath(video string) string {
+	return filepath.Join(filepath.Dir(video), "."+filepath.Base(video)+".hawkeye")
+}
+
+func writeMarker(video, output string) error {
+	info, err := os.Stat(video)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(marker{Output: output, Size: info.Size(), ModTime: info.ModTime(), Converted: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(markerPath(video), append(data, '\n'), 0644)
+}
+
+// Checks if the video was converted and kept and hasn't changed since
+func hasMarker(video string) bool {
+	data, err := os.ReadFile(markerPath(video))
+	if err != nil {
+		return false
+	}
+	var m marker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false
+	}
+
+	info, err := os.Stat(video)
+	return err == nil && info.Size() == m.Size && info.ModTime().Equal(m.ModTime)
+}
+
+// Removes trashed videos once they have been in the trash for longer than the retention
+// period of their root, until the context is cancelled. Runs in separate goroutine
+func purgeTrash(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, root := range currentConfig().Roots {
+			if root.Source == sourceTrash {
+				purgeDir(root.dir(root.TrashDir), time.Now().Add(-root.TrashRetention))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Trashed videos get a record of when they were trashed next to them since the retention
+// period counts from then and only files that hawkeye put there are purged
+type trashRecord struct {
+	Source  string    `json:"source"`
+	Trashed time.Time `json:"trashed"`
+}
+
+const trashRecordSuffix = ".hawkeye-trash"
+
+// The record of a trashed video, hidden like the marker of a kept one
+func trashRecordPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+trashRecordSuffix)
+}
+
+func writeTrashRecord(video, dest string) error {
+	data, err := json.Marshal(trashRecord{Source: video, Trashed: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(trashRecordPath(dest), append(data, '\n'), 0644)
+}
+
+// Removes the videos in the directory that were trashed before the cutoff along with their
+// records and the directories that are left empty. Files without a record are left alone
+func purgeDir(dir string, cutoff time.Time) {
+	var dirs []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Println(err)
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		name := info.Name()
+		if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, trashRecordSuffix) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Println(err)
+			return nil
+		}
+		var record trashRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			logger.Printf("Can't read the trash record %s: %v\n", path, err)
+			return nil
+		}
+		if record.Trashed.After(cutoff) {
+			return nil
+		}
+
+		video := filepath.Join(filepath.Dir(path), strings.TrimSuffix(name[1:], trashRecordSuffix))
+		if err := os.Remove(video); err != nil && !os.IsNotExist(err) {
+			logger.Println(err)
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Println(err)
+			return nil
+		}
+		logger.Printf("Purged %s from the trash\n", video)
+		return nil
+	})
+
+	// deepest first, removing a directory that isn't empty fails
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/simonjm/hawkeye/probe"
+	"golang.org/x/sys/unix"
+)
+
+// Process decides how ffmpeg and ffprobe are run
+type Process struct {
+	Env    []string `yaml:"env"`     // extra environment variables, e.g. LD_LIBRARY_PATH=/opt/ffmpeg/lib
+	Dir    string   `yaml:"dir"`     // working directory
+	Nice   int      `yaml:"nice"`    // niceness of ffmpeg, only used if set
+	IONice string   `yaml:"ionice"`  // io scheduling class of ffmpeg: idle, best-effort or realtime, optionally with :level
+	Cgroup string   `yaml:"cgroup"`  // cgroup v2 directory that ffmpeg is started in
+	CPUMax string   `yaml:"cpu_max"` // written to cpu.max of the cgroup, e.g. "200000 100000" for two CPUs
+}
+
+// The io scheduling classes of ionice
+var ioniceClasses = map[string]string{"realtime": "1", "best-effort": "2", "idle": "3"}
+
+// Makes sure ffmpeg and ffprobe can be run the way the config says before anything is
+// converted. The binaries are resolved to absolute paths and ffmpeg has to have every
+// encoder that the profiles of the roots use
+func checkTools(config *Config) error {
+	var err error
+	if config.FFmpeg, err = lookPath(config.FFmpeg, "ffmpeg"); err != nil {
+		return err
+	}
+	if config.FFprobe, err = lookPath(config.FFprobe, "ffprobe"); err != nil {
+		return err
+	}
+
+	p := config.Process
+	for _, env := range p.Env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("process env %q must be in the form key=value", env)
+		}
+	}
+	if p.Dir != "" {
+		if info, err := os.Stat(p.Dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("process dir %s is not a directory", p.Dir)
+		}
+	}
+	if p.Nice < -20 || p.Nice > 19 {
+		return fmt.Errorf("process nice must be between -20 and 19 but is %d", p.Nice)
+	}
+	if p.Nice != 0 {
+		if _, err := exec.LookPath("nice"); err != nil {
+			return fmt.Errorf("process nice is set but nice can't be found: %v", err)
+		}
+	}
+	if p.IONice != "" {
+		if _, _, err := ioniceArgs(p.IONice); err != nil {
+			return err
+		}
+		if _, err := exec.LookPath("ionice"); err != nil {
+			return fmt.Errorf("process ionice is set but ionice can't be found: %v", err)
+		}
+	}
+	if p.Cgroup != "" {
+		if err := checkCgroup(p.Cgroup); err != nil {
+			return err
+		}
+	} else if p.CPUMax != "" {
+		return fmt.Errorf("process cpu_max needs a cgroup")
+	}
+
+	version, err := config.toolOutput(config.FFmpeg, "-version")
+	if err != nil {
+		return err
+	}
+	if _, err := config.toolOutput(config.FFprobe, "-version"); err != nil {
+		return err
+	}
+
+	output, err := config.toolOutput(config.FFmpeg, "-hide_banner", "-encoders")
+	if err != nil {
+		return err
+	}
+	if err := config.checkEncoders(parseEncoders(output)); err != nil {
+		return err
+	}
+
+	line, _, _ := strings.Cut(string(version), "\n")
+	logger.Printf("Using %s (%s) and %s\n", config.FFmpeg, strings.TrimSpace(line), config.FFprobe)
+	return nil
+}
+
+// Finds the binary in $PATH unless it is a path already
+func lookPath(path, name string) (string, error) {
+	found, err := exec.LookPath(path)
+	if err != nil {
+		return "", fmt.Errorf("%s can't be found at %s, set it with --%s or %s in the config file: %v", name, path, name, name, err)
+	}
+	return filepath.Abs(found)
+}
+
+// How long ffmpeg and ffprobe get to answer when they are checked
+const toolTimeout = 30 * time.Second
+
+// Runs ffmpeg or ffprobe with the arguments and returns what it wrote to stdout
+func (c *Config) toolOutput(path string, args ...string) ([]byte, error) {
+	// a hardware encoder that waits on a device that doesn't answer mustn't hold up the start
+	ctx, cancel := context.WithTimeout(context.Background(), toolTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = c.env()
+	cmd.Dir = c.Process.Dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %v", toolTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s doesn't work: %v: %s", path, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Reads the encoder names from the output of ffmpeg -encoders
+func parseEncoders(output []byte) map[string]bool {
+	encoders := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		// e.g. " V....D libx264    libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || len(fields[0]) != 6 || !strings.ContainsAny(fields[0][:1], "VAS") || fields[1] == "=" {
+			continue
+		}
+		encoders[fields[1]] = true
+	}
+	return encoders
+}
+
+// Parses an ionice setting like idle or best-effort:7 into the class and level arguments
+func ioniceArgs(setting string) (string, string, error) {
+	name, level, _ := strings.Cut(setting, ":")
+	class, ok := ioniceClasses[name]
+	if !ok {
+		return "", "", fmt.Errorf("process ionice class must be idle, best-effort or realtime but is %q", name)
+	}
+	if level != "" {
+		if n, err := strconv.Atoi(level); err != nil || n < 0 || n > 7 {
+			return "", "", fmt.Errorf("process ionice level must be between 0 and 7 but is %q", level)
+		}
+	}
+	return class, level, nil
+}
+
+// Magic number of cgroup2 filesystems in statfs(2)
+const cgroup2SuperMagic = 0x63677270
+
+// Checks that the cgroup can be created where it is
+func checkCgroup(dir string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(filepath.Clean(dir)), &stat); err != nil {
+		return fmt.Errorf("process cgroup: %v", err)
+	}
+	if stat.Type != cgroup2SuperMagic {
+		return fmt.Errorf("process cgroup %s must be inside of a cgroup2 filesystem", dir)
+	}
+	return nil
+}
+
+// Creates the cgroup if it doesn't exist and sets its CPU limit. Only done once the config
+// has been accepted so that a reload that is rejected doesn't change the limit
+func (c *Config) setupCgroup() error {
+	p := c.Process
+	if p.Cgroup == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(p.Cgroup, 0755); err != nil {
+		return fmt.Errorf("process cgroup: %v", err)
+	}
+	if p.CPUMax != "" {
+		if err := os.WriteFile(filepath.Join(p.Cgroup, "cpu.max"), []byte(p.CPUMax), 0644); err != nil {
+			return fmt.Errorf("process cpu_max: %v", err)
+		}
+	}
+	return nil
+}
+
+// The environment ffmpeg and ffprobe are run with, nil to inherit ours
+func (c *Config) env() []string {
+	if len(c.Process.Env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), c.Process.Env...)
+}
+
+// Returns the ffprobe to run
+func (c *Config) prober() probe.Prober {
+	return probe.Prober{Path: c.FFprobe, Env: c.Process.Env, Dir: c.Process.Dir}
+}
+
+// Builds the command that runs ffmpeg with the arguments, wrapped in nice and ionice if
+// they are set and started in the cgroup. The returned func must be called once the
+// command has finished
+func (c *Config) ffmpegCommand(ctx context.Context, args ...string) (*exec.Cmd, func(), error) {
+	p := c.Process
+	name := c.FFmpeg
+	if p.IONice != "" {
+		class, level, _ := ioniceArgs(p.IONice)
+		wrapper := []string{"-c", class}
+		if level != "" {
+			wrapper = append(wrapper, "-n", level)
+		}
+		args = append(append(wrapper, name), args...)
+		name = "ionice"
+	}
+	if p.Nice != 0 {
+		args = append([]string{"-n", strconv.Itoa(p.Nice), name}, args...)
+		name = "nice"
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = c.env()
+	cmd.Dir = p.Dir
+	// don't leave ffmpeg running if we get killed. It gets its own process group so a Ctrl-C
+	// in the terminal only reaches us and running jobs can be drained or cancelled
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL, Setpgid: true}
+
+	if p.Cgroup == "" {
+		return cmd, func() {}, nil
+	}
+
+	cgroup, err := os.Open(p.Cgroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	return cmd, func() { cgroup.Close() }, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEncoders(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   map[string]bool
+	}{
+		{
+			name: "ffmpeg -encoders",
+			output: `Encoders:
+ V..... = Video
+ A..... = Audio
+ S..... = Subtitle
+ .F.... = Frame-level multithreading
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V..... h264_vaapi           H.264/AVC (VAAPI) (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+ S..... mov_text             3GPP Timed Text subtitle
+`,
+			want: map[string]bool{"libx264": true, "h264_vaapi": true, "aac": true, "mov_text": true},
+		},
+		{
+			name:   "nothing listed",
+			output: "Encoders:\n ------\n",
+			want:   map[string]bool{},
+		},
+		{
+			name:   "lines that aren't encoders",
+			output: "ffmpeg version 6.0\n  built with gcc\n XX libfoo\n V....D\n",
+			want:   map[string]bool{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseEncoders([]byte(tt.output)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEncoders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/simonjm/hawkeye/probe"
+)
+
+// Checks if the stream is a commentary track, either by its disposition or its title
+func isCommentary(s probe.Stream) bool {
+	return s.Disposition["comment"] == 1 || strings.Contains(strings.ToLower(s.Title()), "commentary")
+}
+
+// The language of the stream, und if it isn't tagged
+func streamLanguage(s probe.Stream) string {
+	if lang := strings.ToLower(s.Language()); lang != "" {
+		return lang
+	}
+	return "und"
+}
+
+// Picks the audio or subtitle streams that the rule keeps, in the order they end up in the
+// output. Streams in the languages of the rule come first in the order of the list and
+// streams in other languages are dropped. If every stream is a commentary or none of them
+// are in one of the languages they are kept anyway so the video doesn't lose its sound
+func (r StreamRule) selectStreams(streams []probe.Stream) []probe.Stream {
+	var kept []probe.Stream
+	for _, s := range streams {
+		if r.DropCommentary && isCommentary(s) {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if len(kept) == 0 {
+		kept = streams
+	}
+	if len(r.Languages) == 0 {
+		return kept
+	}
+
+	rank := make(map[string]int)
+	for i, lang := range r.Languages {
+		if _, ok := rank[strings.ToLower(lang)]; !ok {
+			rank[strings.ToLower(lang)] = i
+		}
+	}
+
+	var matching []probe.Stream
+	for _, s := range kept {
+		if _, ok := rank[streamLanguage(s)]; ok {
+			matching = append(matching, s)
+		}
+	}
+	if len(matching) == 0 {
+		return kept
+	}
+
+	sort.SliceStable(matching, func(a, b int) bool {
+		return rank[streamLanguage(matching[a])] < rank[streamLanguage(matching[b])]
+	})
+	return matching
+}
+
+// Returns which of the selected streams gets the default disposition: the first one in
+// the default language of the rule, or the first one if required and there is none. -1
+// if no stream should be the default
+func (r StreamRule) defaultStream(streams []probe.Stream, required bool) int {
+	if r.Default != "" {
+		for i, s := range streams {
+			if streamLanguage(s) == strings.ToLower(r.Default) {
+				return i
+			}
+		}
+	}
+	if required && len(streams) > 0 {
+		return 0
+	}
+	return -1
+}
+
+// Checks if the rule says anything about subtitles. Subtitles are only kept if it does
+// since most of them can't be put into an mp4 as they are
+func (r StreamRule) isSet() bool {
+	return len(r.Copy) > 0 || len(r.chain()) > 0 || len(r.Languages) > 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/simonjm/hawkeye/probe"
+)
+
+// An audio or subtitle stream with the language and title tags, if they aren't empty
+func testStream(index int, codecType, lang, title string) probe.Stream {
+	s := probe.Stream{Index: index, CodecName: "aac", CodecType: codecType, Tags: make(map[string]string)}
+	if lang != "" {
+		s.Tags["language"] = lang
+	}
+	if title != "" {
+		s.Tags["title"] = title
+	}
+	return s
+}
+
+func streamIndexes(streams []probe.Stream) []int {
+	indexes := []int{}
+	for _, s := range streams {
+		indexes = append(indexes, s.Index)
+	}
+	return indexes
+}
+
+func TestSelectStreams(t *testing.T) {
+	commentary := testStream(4, probe.Audio, "eng", "")
+	commentary.Disposition = map[string]int{"comment": 1}
+
+	streams := []probe.Stream{
+		testStream(1, probe.Audio, "eng", ""),
+		testStream(2, probe.Audio, "jpn", ""),
+		testStream(3, probe.Audio, "eng", "Director's Commentary"),
+		commentary,
+		testStream(5, probe.Audio, "", ""),
+	}
+
+	tests := []struct {
+		name    string
+		rule    StreamRule
+		streams []probe.Stream
+		want    []int
+	}{
+		{"everything", StreamRule{}, streams, []int{1, 2, 3, 4, 5}},
+		{"language order", StreamRule{Languages: []string{"jpn", "eng"}}, streams, []int{2, 1, 3, 4}},
+		{"languages are case insensitive", StreamRule{Languages: []string{"JPN"}}, streams, []int{2}},
+		{"untagged", StreamRule{Languages: []string{"und"}}, streams, []int{5}},
+		{"no language matches", StreamRule{Languages: []string{"fre"}}, streams, []int{1, 2, 3, 4, 5}},
+		{"drop commentary", StreamRule{DropCommentary: true}, streams, []int{1, 2, 5}},
+		{"drop commentary with languages", StreamRule{Languages: []string{"eng"}, DropCommentary: true}, streams, []int{1}},
+		{
+			name:    "only commentary",
+			rule:    StreamRule{DropCommentary: true},
+			streams: streams[2:4],
+			want:    []int{3, 4},
+		},
+		{
+			name:    "only commentary with languages",
+			rule:    StreamRule{Languages: []string{"jpn"}, DropCommentary: true},
+			streams: streams[2:4],
+			want:    []int{3, 4},
+		},
+		{"no streams", StreamRule{Languages: []string{"eng"}, DropCommentary: true}, nil, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamIndexes(tt.rule.selectStreams(tt.streams)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectStreams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultStream(t *testing.T) {
+	streams := []probe.Stream{
+		testStream(1, probe.Audio, "eng", ""),
+		testStream(2, probe.Audio, "jpn", ""),
+	}
+
+	tests := []struct {
+		name     string
+		rule     StreamRule
+		streams  []probe.Stream
+		required bool
+		want     int
+	}{
+		{"default language", StreamRule{Default: "jpn"}, streams, true, 1},
+		{"default language is case insensitive", StreamRule{Default: "JPN"}, streams, false, 1},
+		{"missing language falls back to the first", StreamRule{Default: "fre"}, streams, true, 0},
+		{"missing language without one required", StreamRule{Default: "fre"}, streams, false, -1},
+		{"no default language", StreamRule{}, streams, true, 0},
+		{"no streams", StreamRule{Default: "eng"}, nil, true, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.defaultStream(tt.streams, tt.required); got != tt.want {
+				t.Errorf("defaultStream() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
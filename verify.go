@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/simonjm/hawkeye/probe"
+)
+
+// Checks that ffmpeg wrote a complete file before the source gets deleted. The output
+// must have exactly the streams we asked for and about the same duration as the source. The
+// output of ffprobe and ffmpeg goes to the job log
+func verifyOutput(ctx context.Context, config *Config, source *probe.MediaInfo, expected map[string]int, output string, jlog *jobLog) error {
+	prober := config.prober()
+	prober.Stderr = jlog.stderr(append([]string{prober.Path}, probe.Args(output)...)...)
+	info, err := prober.Probe(ctx, output)
+	if err != nil {
+		return fmt.Errorf("verify %s: %v", output, err)
+	}
+
+	for codecType, want := range expected {
+		if got := len(info.StreamsOfType(codecType)); got != want {
+			return fmt.Errorf("verify %s: expected %d %s streams but found %d", output, want, codecType, got)
+		}
+	}
+
+	if source.Format.Duration > 0 {
+		diff := math.Abs(source.Format.Duration - info.Format.Duration)
+		if time.Duration(diff*float64(time.Second)) > *verifyTolerance {
+			return fmt.Errorf("verify %s: duration is %.2fs but the source is %.2fs",
+				output, info.Format.Duration, source.Format.Duration)
+		}
+	}
+
+	if *verifyDecode {
+		cmd, done, err := config.ffmpegCommand(ctx, "-v", "error", "-i", output, "-f", "null", "-")
+		if err != nil {
+			return fmt.Errorf("verify %s: %v", output, err)
+		}
+		defer done()
+		jlog.attach(cmd)
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("verify %s: decoding failed: %v", output, err)
+		}
+	}
+
+	return nil
+}
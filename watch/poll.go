@@ -0,0 +1,235 @@
+package watch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/simonjm/hawkeye/inotify"
+)
+
+// Poller is a Watcher that walks the watched trees every interval and compares
+// them to the previous walk. New files are reported as Create, changed ones as
+// Write, removed ones as Remove and files that kept their inode under a new name
+// as Rename.
+type Poller struct {
+	interval time.Duration
+	events   chan inotify.Event
+	errors   chan error
+	mu       sync.Mutex           // Protects roots and files
+	roots    map[string]bool      // Directories that are walked
+	files    map[string]fileState // Everything that was found by the last walk
+	done     chan struct{}        // Channel for sending a "quit message" to the poll goroutine
+	doneResp chan struct{}        // Channel to respond to Close
+	closing  sync.Once
+}
+
+// What a file looked like when it was last walked
+type fileState struct {
+	size    int64
+	modTime time.Time
+	dev     uint64
+	ino     uint64
+	isDir   bool
+}
+
+func newFileState(info os.FileInfo) fileState {
+	s := fileState{size: info.Size(), modTime: info.ModTime(), isDir: info.IsDir()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		s.dev = uint64(stat.Dev)
+		s.ino = uint64(stat.Ino)
+	}
+	return s
+}
+
+// NewPoller creates a Poller that walks the watched directories every interval.
+func NewPoller(interval time.Duration) *Poller {
+	p := &Poller{
+		interval: interval,
+		events:   make(chan inotify.Event),
+		errors:   make(chan error),
+		roots:    make(map[string]bool),
+		files:    make(map[string]fileState),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+	go p.poll()
+	return p
+}
+
+// AddRecursive starts watching the named directory and every directory below it.
+// Files that are already in it are not reported.
+func (p *Poller) AddRecursive(name string) error {
+	name = filepath.Clean(name)
+	files, err := walk(name)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		return errors.New("poller already closed")
+	default:
+	}
+
+	p.roots[name] = true
+	for path, state := range files {
+		p.files[path] = state
+	}
+	return nil
+}
+
+// Events returns the channel that changes are sent on.
+func (p *Poller) Events() <-chan inotify.Event {
+	return p.events
+}
+
+// Errors returns the channel that errors are sent on.
+func (p *Poller) Errors() <-chan error {
+	return p.errors
+}
+
+// Close stops polling and closes the Events and Errors channels.
+func (p *Poller) Close() error {
+	p.closing.Do(func() { close(p.done) })
+	<-p.doneResp
+	return nil
+}
+
+// Walks the roots every interval and sends the differences until the poller is closed
+func (p *Poller) poll() {
+	defer close(p.doneResp)
+	defer close(p.errors)
+	defer close(p.events)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		roots := make([]string, 0, len(p.roots))
+		for root := range p.roots {
+			roots = append(roots, root)
+		}
+		p.mu.Unlock()
+
+		current := make(map[string]fileState)
+		for _, root := range roots {
+			files, err := walk(root)
+			if err != nil {
+				if !p.sendError(err) {
+					return
+				}
+				// keep what we knew about an unreachable root instead of reporting it all as removed
+				p.mu.Lock()
+				for path, state := range p.files {
+					if path == root || isBelow(root, path) {
+						current[path] = state
+					}
+				}
+				p.mu.Unlock()
+				continue
+			}
+			for path, state := range files {
+				current[path] = state
+			}
+		}
+
+		p.mu.Lock()
+		previous := p.files
+		p.files = current
+		p.mu.Unlock()
+
+		for _, ev := range diff(previous, current) {
+			select {
+			case p.events <- ev:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *Poller) sendError(err error) bool {
+	select {
+	case p.errors <- err:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// Returns the events that turn the previous walk into the current one
+func diff(previous, current map[string]fileState) []inotify.Event {
+	var events []inotify.Event
+
+	// files that disappeared, by inode, so renames can be told apart from new files
+	type inode struct{ dev, ino uint64 }
+	removed := make(map[inode]string)
+	for path, old := range previous {
+		if _, ok := current[path]; !ok && old.ino != 0 {
+			removed[inode{old.dev, old.ino}] = path
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for path, state := range current {
+		old, ok := previous[path]
+		switch {
+		case !ok:
+			key := inode{state.dev, state.ino}
+			if oldPath, moved := removed[key]; moved && state.ino != 0 {
+				delete(removed, key)
+				renamed[oldPath] = true
+				events = append(events, inotify.Event{Name: path, OldName: oldPath, Op: inotify.Rename})
+				continue
+			}
+			events = append(events, inotify.Event{Name: path, Op: inotify.Create})
+		case !state.isDir && (state.size != old.size || !state.modTime.Equal(old.modTime)):
+			events = append(events, inotify.Event{Name: path, Op: inotify.Write})
+		}
+	}
+
+	for path := range previous {
+		if _, ok := current[path]; !ok && !renamed[path] {
+			events = append(events, inotify.Event{Name: path, Op: inotify.Remove})
+		}
+	}
+
+	return events
+}
+
+// Walks the tree rooted at name. Only errors for the root itself are returned
+// since anything below it may be removed while it is being walked.
+func walk(name string) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == name {
+				return err
+			}
+			return nil
+		}
+
+		files[path] = newFileState(info)
+		return nil
+	})
+	return files, err
+}
+
+// Checks if path is inside of the directory dir
+func isBelow(dir, path string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
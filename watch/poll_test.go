@@ -0,0 +1,96 @@
+package watch
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/simonjm/hawkeye/inotify"
+)
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+	file := func(ino uint64, size int64) fileState {
+		return fileState{size: size, modTime: now, dev: 1, ino: ino}
+	}
+	dir := fileState{modTime: now, dev: 1, ino: 100, isDir: true}
+
+	tests := []struct {
+		name     string
+		previous map[string]fileState
+		current  map[string]fileState
+		want     []inotify.Event
+	}{
+		{
+			name:     "nothing changed",
+			previous: map[string]fileState{"/in": dir, "/in/a.mkv": file(1, 10)},
+			current:  map[string]fileState{"/in": dir, "/in/a.mkv": file(1, 10)},
+			want:     nil,
+		},
+		{
+			name:     "created",
+			previous: map[string]fileState{"/in": dir},
+			current:  map[string]fileState{"/in": dir, "/in/a.mkv": file(1, 10)},
+			want:     []inotify.Event{{Name: "/in/a.mkv", Op: inotify.Create}},
+		},
+		{
+			name:     "written",
+			previous: map[string]fileState{"/in/a.mkv": file(1, 10)},
+			current:  map[string]fileState{"/in/a.mkv": file(1, 20)},
+			want:     []inotify.Event{{Name: "/in/a.mkv", Op: inotify.Write}},
+		},
+		{
+			name:     "touched",
+			previous: map[string]fileState{"/in/a.mkv": file(1, 10)},
+			current:  map[string]fileState{"/in/a.mkv": {size: 10, modTime: now.Add(time.Second), dev: 1, ino: 1}},
+			want:     []inotify.Event{{Name: "/in/a.mkv", Op: inotify.Write}},
+		},
+		{
+			name:     "removed",
+			previous: map[string]fileState{"/in/a.mkv": file(1, 10)},
+			current:  map[string]fileState{},
+			want:     []inotify.Event{{Name: "/in/a.mkv", Op: inotify.Remove}},
+		},
+		{
+			name:     "renamed by inode",
+			previous: map[string]fileState{"/in/a.mkv": file(1, 10)},
+			current:  map[string]fileState{"/in/b.mkv": file(1, 10)},
+			want:     []inotify.Event{{Name: "/in/b.mkv", OldName: "/in/a.mkv", Op: inotify.Rename}},
+		},
+		{
+			name:     "replaced by a new file",
+			previous: map[string]fileState{"/in/a.mkv": file(1, 10)},
+			current:  map[string]fileState{"/in/b.mkv": file(2, 10)},
+			want: []inotify.Event{
+				{Name: "/in/a.mkv", Op: inotify.Remove},
+				{Name: "/in/b.mkv", Op: inotify.Create},
+			},
+		},
+		{
+			name:     "no inodes",
+			previous: map[string]fileState{"/in/a.mkv": {size: 10, modTime: now}},
+			current:  map[string]fileState{"/in/b.mkv": {size: 10, modTime: now}},
+			want: []inotify.Event{
+				{Name: "/in/a.mkv", Op: inotify.Remove},
+				{Name: "/in/b.mkv", Op: inotify.Create},
+			},
+		},
+		{
+			name:     "directory changed",
+			previous: map[string]fileState{"/in": dir},
+			current:  map[string]fileState{"/in": {modTime: now.Add(time.Second), dev: 1, ino: 100, isDir: true}},
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diff(tt.previous, tt.current)
+			sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Package watch reports new and changed files in directory trees, either with
+// inotify or by polling for filesystems where inotify doesn't see every change.
+package watch
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/simonjm/hawkeye/inotify"
+	"golang.org/x/sys/unix"
+)
+
+// Watcher watches directory trees and reports changes to the files in them.
+type Watcher interface {
+	// AddRecursive starts watching the named directory and every directory below it.
+	AddRecursive(name string) error
+	// Events returns the channel that changes are sent on.
+	Events() <-chan inotify.Event
+	// Errors returns the channel that errors are sent on.
+	Errors() <-chan error
+	// Close stops watching and closes the Events and Errors channels.
+	Close() error
+}
+
+// Backend selects how a directory is watched.
+type Backend string
+
+// The backends that can be picked for a directory.
+const (
+	Auto     Backend = "auto"     // Poll network filesystems and use inotify for the rest
+	Inotify  Backend = "inotify"  // Use inotify
+	Fanotify Backend = "fanotify" // Mark the whole filesystem with fanotify
+	Poll     Backend = "poll"     // Periodically walk the tree and compare it to the last walk
+)
+
+// ParseBackend returns the backend with the name.
+func ParseBackend(name string) (Backend, error) {
+	switch b := Backend(name); b {
+	case Auto, Inotify, Fanotify, Poll:
+		return b, nil
+	}
+	return "", fmt.Errorf("unknown watch backend %q, expected auto, inotify, fanotify or poll", name)
+}
+
+// Filesystem magic numbers from statfs(2) for filesystems where changes made by
+// other hosts don't show up in inotify.
+var remoteFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517B:     "smb",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x00C36400: "ceph",
+	0x5346414F: "afs",
+}
+
+// Detect picks the backend for the directory based on the filesystem it is on.
+// Network and FUSE filesystems such as NFS, CIFS and SSHFS are polled.
+func Detect(name string) (Backend, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(name, &stat); err != nil {
+		return "", &os.PathError{Op: "statfs", Path: name, Err: err}
+	}
+
+	// the type is signed on some architectures
+	if _, ok := remoteFilesystems[uint32(stat.Type)]; ok {
+		return Poll, nil
+	}
+	return Inotify, nil
+}
+
+// NewInotify returns a Watcher that uses inotify and only reports the events in mask.
+func NewInotify(mask uint32) (Watcher, error) {
+	w, err := inotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &inotifyWatcher{watcher: w, mask: mask}, nil
+}
+
+// Adapts inotify.Watcher to the Watcher interface
+type inotifyWatcher struct {
+	watcher *inotify.Watcher
+	mask    uint32
+}
+
+func (w *inotifyWatcher) AddRecursive(name string) error {
+	return w.watcher.AddRecursive(name, w.mask)
+}
+
+func (w *inotifyWatcher) Events() <-chan inotify.Event {
+	return w.watcher.Events
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.watcher.Errors
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// NewFanotify returns a Watcher that uses fanotify and only reports the events in
+// mask. It fails when the process isn't allowed to use fanotify.
+func NewFanotify(mask uint32) (Watcher, error) {
+	w, err := inotify.NewFanotifyWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fanotifyWatcher{watcher: w, mask: mask}, nil
+}
+
+// Adapts inotify.FanotifyWatcher to the Watcher interface
+type fanotifyWatcher struct {
+	watcher *inotify.FanotifyWatcher
+	mask    uint32
+}
+
+func (w *fanotifyWatcher) AddRecursive(name string) error {
+	return w.watcher.AddRecursive(name, w.mask)
+}
+
+func (w *fanotifyWatcher) Events() <-chan inotify.Event {
+	return w.watcher.Events
+}
+
+func (w *fanotifyWatcher) Errors() <-chan error {
+	return w.watcher.Errors
+}
+
+func (w *fanotifyWatcher) Close() error {
+	return w.watcher.Close()
+}